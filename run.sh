@@ -1,7 +1,12 @@
-if [[ -n $MS_CONFIG_DATA ]]; then
-    echo $MS_CONFIG_DATA | base64 -d > ms_config.json
+# The config comes from MS_CONFIG_DATA (base64), or from a mounted file at MS_CONFIG_PATH.
+# MS_CONFIG_FORMAT is json (default), yaml or toml, and is only needed for MS_CONFIG_DATA.
+if [[ -n $MS_CONFIG_PATH ]]; then
+    CONFIG_PATH=$MS_CONFIG_PATH
+elif [[ -n $MS_CONFIG_DATA ]]; then
+    CONFIG_PATH=ms_config.${MS_CONFIG_FORMAT:-json}
+    echo $MS_CONFIG_DATA | base64 -d > $CONFIG_PATH
 else
-    echo "Missing MS_CONFIG_DATA env var"
+    echo "Missing MS_CONFIG_DATA or MS_CONFIG_PATH env var"
     exit 1
 fi
-/app/os-serverlist-sync
\ No newline at end of file
+exec /app/os-serverlist-sync -config "$CONFIG_PATH" "$@"
@@ -0,0 +1,76 @@
+package Config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	FORMAT_JSON = "json"
+	FORMAT_YAML = "yaml"
+	FORMAT_TOML = "toml"
+)
+
+// Picks the config format from the file extension, anything unrecognised is read as JSON
+func GetFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return FORMAT_YAML
+	case ".toml":
+		return FORMAT_TOML
+	}
+	return FORMAT_JSON
+}
+
+/*
+Reads a config file in any supported format and returns it as JSON, so Parse and its JSON paths work
+the same for every format. The pipelines are either the top level array, or the "pipelines" array
+of a top level object, which is the only option in TOML:
+
+	[[pipelines]]
+	Name = "example"
+*/
+func ReadFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ToJSON(data, GetFormat(path))
+}
+
+func ToJSON(data []byte, format string) ([]byte, error) {
+	var document interface{}
+
+	switch format {
+	case FORMAT_JSON:
+		if err := json.Unmarshal(data, &document); err != nil {
+			return data, nil //left for Parse to report with its line and column
+		}
+	case FORMAT_YAML:
+		if err := yaml.Unmarshal(data, &document); err != nil {
+			return nil, fmt.Errorf("invalid YAML: %w", err)
+		}
+	case FORMAT_TOML:
+		if _, err := toml.Decode(string(data), &document); err != nil {
+			return nil, fmt.Errorf("invalid TOML: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported config format %q", format)
+	}
+
+	if object, isObject := document.(map[string]interface{}); isObject {
+		if pipelines, exists := object["pipelines"]; exists {
+			return json.Marshal(pipelines)
+		}
+	}
+	if format == FORMAT_JSON {
+		return data, nil
+	}
+	return json.Marshal(document)
+}
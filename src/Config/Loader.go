@@ -0,0 +1,338 @@
+package Config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os-serverlist-sync/Engine"
+	"strings"
+	"time"
+)
+
+// A problem found in the config, Path is a JSON path such as $[0].MsEngine.params.address
+type ValidationError struct {
+	Pipeline int //index of the pipeline, -1 for problems with the config as a whole
+	Path     string
+	Message  string
+}
+
+func (e ValidationError) Error() string {
+	var location = e.Path
+	if e.Pipeline >= 0 {
+		location = fmt.Sprintf("pipeline %d: %s", e.Pipeline, e.Path)
+	}
+	if len(location) == 0 {
+		return e.Message
+	}
+	return fmt.Sprintf("%s: %s", location, e.Message)
+}
+
+// Every problem found in a config, in the order they appear
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	var messages []string
+	for _, validationError := range e {
+		messages = append(messages, validationError.Error())
+	}
+	return strings.Join(messages, "\n")
+}
+
+/*
+Decodes and validates a config without creating any engines, so no sockets are opened.
+Unnamed pipelines are named pipeline<index>. Every problem is returned rather than just the first.
+*/
+func Parse(data []byte) ([]EngineConfigurationPlain, ValidationErrors) {
+	var rawPipelines []json.RawMessage
+	if err := json.Unmarshal(data, &rawPipelines); err != nil {
+		return nil, ValidationErrors{getJSONError(-1, "$", data, err)}
+	}
+
+	var plains []EngineConfigurationPlain
+	var validationErrors ValidationErrors
+	for i, rawPipeline := range rawPipelines {
+		plain, pipelineErrors := parsePipeline(i, rawPipeline)
+		plains = append(plains, plain)
+		validationErrors = append(validationErrors, pipelineErrors...)
+	}
+
+	validationErrors = append(validationErrors, checkUnique(plains)...)
+	return plains, validationErrors
+}
+
+func parsePipeline(index int, data json.RawMessage) (EngineConfigurationPlain, ValidationErrors) {
+	var plain EngineConfigurationPlain
+	var validationErrors ValidationErrors
+	var path = fmt.Sprintf("$[%d]", index)
+
+	var rawPipeline struct {
+		Name          string            `json:"Name"`
+		SyncInterval  int               `json:"SyncInterval"`
+		MsEngine      json.RawMessage   `json:"MsEngine"`
+		MsEngines     []json.RawMessage `json:"MsEngines"`
+		QueryEngine   json.RawMessage   `json:"QueryEngine"`
+		OutputEngine  json.RawMessage   `json:"OutputEngine"`
+		OutputEngines []json.RawMessage `json:"OutputEngines"`
+	}
+	if err := json.Unmarshal(data, &rawPipeline); err != nil {
+		return plain, ValidationErrors{getJSONError(index, path, data, err)}
+	}
+
+	plain.Name = rawPipeline.Name
+	if len(plain.Name) == 0 {
+		plain.Name = fmt.Sprintf("pipeline%d", index)
+	}
+	plain.SyncInterval = rawPipeline.SyncInterval
+
+	rawMsEngines, msEnginePaths, listErrors := getBlockList(index, path, "MsEngine", rawPipeline.MsEngine, rawPipeline.MsEngines)
+	validationErrors = append(validationErrors, listErrors...)
+	if len(rawMsEngines) == 0 {
+		validationErrors = append(validationErrors, ValidationError{index, path + ".MsEngine", "is required"})
+	}
+	plain.MsEngines = make([]MsEngineBlock, len(rawMsEngines))
+	for i, rawMsEngine := range rawMsEngines {
+		var msEngine = &plain.MsEngines[i]
+		validationErrors = append(validationErrors, decodeBlock(index, msEnginePaths[i], rawMsEngine, Engine.LookupServerListEngine,
+			msEngine, &msEngine.Name, &msEngine.Params)...)
+	}
+
+	if isMissing(rawPipeline.QueryEngine) {
+		validationErrors = append(validationErrors, ValidationError{index, path + ".QueryEngine", "is required"})
+	} else {
+		var blockErrors = decodeBlock(index, path+".QueryEngine", rawPipeline.QueryEngine, Engine.LookupQueryEngine,
+			&plain.QueryEngine, &plain.QueryEngine.Name, &plain.QueryEngine.Params)
+		validationErrors = append(validationErrors, blockErrors...)
+
+		if len(blockErrors) == 0 {
+			if plain.QueryEngine.Retry != nil {
+				validationErrors = append(validationErrors, getValidationErrors(index, path+".QueryEngine.retry", Engine.ValidateParams(plain.QueryEngine.Retry))...)
+			}
+			validationErrors = append(validationErrors, getValidationErrors(index, path+".QueryEngine.rate_limit", Engine.ValidateParams(&plain.QueryEngine.RateLimit))...)
+		}
+	}
+
+	rawOutputs, outputPaths, listErrors := getBlockList(index, path, "OutputEngine", rawPipeline.OutputEngine, rawPipeline.OutputEngines)
+	validationErrors = append(validationErrors, listErrors...)
+	plain.OutputEngines = make([]OutputEngineBlock, len(rawOutputs))
+	for i, rawOutput := range rawOutputs {
+		var output = &plain.OutputEngines[i]
+		validationErrors = append(validationErrors, decodeBlock(index, outputPaths[i], rawOutput, Engine.LookupOutputHandler,
+			output, &output.Name, &output.Params)...)
+	}
+
+	return plain, validationErrors
+}
+
+/*
+Engine blocks which can be given either as a single block under key, or as a list under key + "s".
+Returns the blocks with the path of each.
+*/
+func getBlockList(index int, path string, key string, single json.RawMessage, list []json.RawMessage) ([]json.RawMessage, []string, ValidationErrors) {
+	var validationErrors ValidationErrors
+	var paths []string
+	for i := range list {
+		paths = append(paths, fmt.Sprintf("%s.%ss[%d]", path, key, i))
+	}
+	if !isMissing(single) {
+		if len(list) > 0 {
+			validationErrors = append(validationErrors, ValidationError{index, path + "." + key, fmt.Sprintf("can't be used together with %ss", key)})
+		}
+		list = append(list, single)
+		paths = append(paths, path+"."+key)
+	}
+	return list, paths, validationErrors
+}
+
+func isMissing(data json.RawMessage) bool {
+	return len(data) == 0 || bytes.Equal(data, []byte("null"))
+}
+
+/*
+Decodes an engine block, with its params decoded into a new params struct of the named engine, and
+checks the params. name and params point into block.
+*/
+func decodeBlock[T any](index int, path string, data json.RawMessage, lookup func(string) (Engine.Registration[T], error), block interface{}, name *string, params *interface{}) ValidationErrors {
+	var typ struct {
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(data, &typ); err != nil {
+		return ValidationErrors{getJSONError(index, path, data, err)}
+	}
+	if len(typ.Name) == 0 {
+		return ValidationErrors{{index, path + ".name", "is required"}}
+	}
+
+	registration, err := lookup(typ.Name)
+	if err != nil {
+		return ValidationErrors{{index, path + ".name", err.Error()}}
+	}
+
+	*params = registration.NewParams() //the params object is decoded into the struct this points to
+	if err := json.Unmarshal(data, block); err != nil {
+		return ValidationErrors{getJSONError(index, path, data, err)}
+	}
+	*name = typ.Name
+
+	//references are resolved first, so the checks see the real values
+	var secretErrors = Engine.ResolveSecrets(*params)
+	if len(secretErrors) > 0 {
+		return getValidationErrors(index, path+".params", secretErrors)
+	}
+	return getValidationErrors(index, path+".params", Engine.ValidateParams(*params))
+}
+
+func getValidationErrors(index int, path string, paramErrors []Engine.ParamError) ValidationErrors {
+	var validationErrors ValidationErrors
+	for _, paramError := range paramErrors {
+		var fieldPath = path
+		if len(paramError.Field) > 0 {
+			fieldPath = path + "." + paramError.Field
+		}
+		validationErrors = append(validationErrors, ValidationError{index, fieldPath, paramError.Message})
+	}
+	return validationErrors
+}
+
+// Whether a query engine's params ask for its port to be shared with other query engines
+func isSharedPort(params interface{}) bool {
+	shared, ok := params.(Engine.ISharedPortParams)
+	return ok && shared.IsSharedPort()
+}
+
+// Pipeline names must not be shared between pipelines, nor bound ports unless every engine binding one shares it
+func checkUnique(plains []EngineConfigurationPlain) ValidationErrors {
+	var validationErrors ValidationErrors
+	var names = make(map[string]int)
+	var ports = make(map[int]int)
+	var sharedPorts = make(map[int]bool)
+
+	for i, plain := range plains {
+		if first, exists := names[plain.Name]; exists {
+			validationErrors = append(validationErrors, ValidationError{i, fmt.Sprintf("$[%d].Name", i), fmt.Sprintf("%q is already used by pipeline %d", plain.Name, first)})
+		} else {
+			names[plain.Name] = i
+		}
+
+		var shared = isSharedPort(plain.QueryEngine.Params)
+		for field, port := range Engine.BindPorts(plain.QueryEngine.Params) {
+			if first, exists := ports[port]; exists {
+				if shared && sharedPorts[port] {
+					continue
+				}
+				validationErrors = append(validationErrors, ValidationError{i, fmt.Sprintf("$[%d].QueryEngine.params.%s", i, field),
+					fmt.Sprintf("port %d is already used by pipeline %d, set shared_port on both to share it", port, first)})
+			} else {
+				ports[port] = i
+				sharedPorts[port] = shared
+			}
+		}
+	}
+	return validationErrors
+}
+
+// Turns a decoding error into a ValidationError, with the line and column for syntax errors
+func getJSONError(index int, path string, data []byte, err error) ValidationError {
+	var syntaxError *json.SyntaxError
+	var typeError *json.UnmarshalTypeError
+
+	if errors.As(err, &syntaxError) {
+		var before = data[:syntaxError.Offset]
+		var line = bytes.Count(before, []byte("\n")) + 1
+		var column = len(before) - bytes.LastIndexByte(before, '\n')
+		return ValidationError{index, path, fmt.Sprintf("%s (line %d, column %d)", syntaxError.Error(), line, column)}
+	}
+	if errors.As(err, &typeError) {
+		if len(typeError.Field) > 0 {
+			path = path + "." + typeError.Field
+		}
+		return ValidationError{index, path, fmt.Sprintf("expected %s, got %s", typeError.Type.String(), typeError.Value)}
+	}
+	return ValidationError{index, path, err.Error()}
+}
+
+// Identifies a parsed pipeline's settings, with secrets resolved, so a reloaded config can be compared against the running one
+func (p EngineConfigurationPlain) Fingerprint() (string, error) {
+	data, err := json.Marshal(p)
+	return string(data), err
+}
+
+// The engine name, numbered when a pipeline has the same engine more than once, e.g. goa0#2
+func getSourceName(blocks []MsEngineBlock, index int) string {
+	var name = blocks[index].Name
+	var count, number = 0, 0
+	for i, block := range blocks {
+		if block.Name == name {
+			count++
+			if i <= index {
+				number++
+			}
+		}
+	}
+	if count == 1 {
+		return name
+	}
+	return fmt.Sprintf("%s#%d", name, number)
+}
+
+// Creates and configures the engines of parsed pipelines. The query engines bind their sockets here
+func Build(plains []EngineConfigurationPlain) []EngineConfiguration {
+	var params []EngineConfiguration
+	for _, plain := range plains {
+		params = append(params, buildPipeline(plain))
+	}
+	return params
+}
+
+func buildPipeline(typ EngineConfigurationPlain) EngineConfiguration {
+	var b EngineConfiguration
+
+	b.Name = typ.Name
+	b.QueryEngineName = typ.QueryEngine.Name
+
+	var syncInterval = typ.SyncInterval
+	if syncInterval <= 0 {
+		syncInterval = DEFAULT_SYNC_INTERVAL_SECS
+	}
+	b.SyncInterval = time.Duration(syncInterval) * time.Second
+
+	//Parse has already checked the names
+	var msEngineNames []string
+	for i, msBlock := range typ.MsEngines {
+		msRegistration, _ := Engine.LookupServerListEngine(msBlock.Name)
+		var msEngine = msRegistration.New()
+		msEngine.SetParams(msBlock.Params)
+		b.MsEngines = append(b.MsEngines, Engine.ServerListSource{Name: getSourceName(typ.MsEngines, i), Engine: msEngine})
+		msEngineNames = append(msEngineNames, msBlock.Name)
+	}
+	b.MsEngineName = strings.Join(msEngineNames, "+")
+
+	if len(b.MsEngines) == 1 {
+		b.ServerListEngine = b.MsEngines[0].Engine
+	} else {
+		b.ServerListEngine = Engine.NewServerListEngineGroup(b.MsEngines)
+	}
+
+	queryRegistration, _ := Engine.LookupQueryEngine(typ.QueryEngine.Name)
+	b.QueryEngine = queryRegistration.New()
+	b.QueryEngine.SetParams(typ.QueryEngine.Params)
+
+	b.RetryPolicy = Engine.DefaultRetryPolicy()
+	if typ.QueryEngine.Retry != nil {
+		b.RetryPolicy = typ.QueryEngine.Retry.WithDefaults()
+	}
+	b.RateLimit = typ.QueryEngine.RateLimit
+
+	for _, outputBlock := range typ.OutputEngines {
+		outputRegistration, _ := Engine.LookupOutputHandler(outputBlock.Name)
+		var handler = outputRegistration.New()
+		handler.SetParams(outputBlock.Params)
+		b.Outputs = append(b.Outputs, Engine.Output{Name: outputBlock.Name, Handler: handler})
+	}
+
+	b.ServerListEngine.SetQueryEngine(b.QueryEngine)
+
+	b.ConnectOutputs()
+
+	return b
+}
@@ -0,0 +1,13 @@
+package Engine
+
+import "net/netip"
+
+// Dual-stack sockets report IPv4 sources as ::ffff:a.b.c.d, this returns them as the plain IPv4 address they were listed as
+func NormalizeAddrPort(address netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(NormalizeAddr(address.Addr()), address.Port())
+}
+
+// As NormalizeAddrPort, for addresses without a port such as resolved hosts
+func NormalizeAddr(addr netip.Addr) netip.Addr {
+	return addr.Unmap()
+}
@@ -0,0 +1,8 @@
+package Engine
+
+import "context"
+
+// Implemented by engines and output handlers which can report whether they are able to do their job, used for readiness
+type IHealthChecker interface {
+	CheckHealth(ctx context.Context) error
+}
@@ -3,9 +3,19 @@ package Engine
 import "net/netip"
 
 type IQueryEngine interface {
-	SetMonitor(monitor SyncStatusMonitor)
+	SetMonitor(monitor *SyncStatusMonitor)
 	SetParams(params interface{})
 	SetOutputHandler(handler IQueryOutputHandler)
 	Query(address netip.AddrPort)
 	Shutdown()
 }
+
+// Implemented by query engines which send more than one packet per query, so the rate limit charges each of them
+type IQueryPacketCounter interface {
+	PacketsPerQuery() int
+}
+
+// Implemented by query engines which write servers to outputs under another address than the one listed
+type IOutputAddressMapper interface {
+	GetOutputAddress(address netip.AddrPort) netip.AddrPort
+}
@@ -1,11 +1,44 @@
 package Engine
-import "net"
+
+import (
+	"net"
+	"net/netip"
+)
 
 type IQueryOutputHandler interface {
 
-	// Called when a UDP server responds
-	// TODO: have server rules (hostname, etc)
+	// Called when a UDP server responds, with ServerInfo.Keys unless the handler implements IServerInfoOutputHandler
 	OnServerInfoResponse(sourceAddress net.Addr, serverProperties map[string]string)
 
 	SetParams(params interface{})
-}
\ No newline at end of file
+}
+
+// Implemented by output handlers which use players, teams or rules, given every response instead of OnServerInfoResponse
+type IServerInfoOutputHandler interface {
+	OnServerInfo(sourceAddress net.Addr, info *ServerInfo)
+}
+
+// Implemented by output handlers which stage their writes, called when the pipeline shuts down and, unless the handler implements OnRunComplete, at the end of each sync cycle
+type IQueryOutputFlusher interface {
+	Flush() error
+}
+
+/*
+Implemented by output handlers which react to more than responses. Handlers are given these in order
+with their responses, on the same goroutine. Embed OutputLifecycleBase to implement only some of them.
+*/
+type IQueryOutputLifecycleHandler interface {
+	IQueryOutputHandler
+	IQueryOutputLifecycle
+}
+
+type IQueryOutputLifecycle interface {
+	// Called when a listed server hasn't responded to any attempt, with the address its responses are written under
+	OnServerTimeout(address netip.AddrPort)
+
+	// Called when a server list source ends, with the number of servers it listed and the error it failed with
+	OnListEngineComplete(source string, count int, err error)
+
+	// Called at the end of each sync cycle, once its responses have been given to the handler
+	OnRunComplete(summary RunSummary)
+}
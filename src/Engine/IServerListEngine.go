@@ -5,6 +5,6 @@ import "context"
 type IServerListEngine interface {
 	SetQueryEngine(engine IQueryEngine)
 	SetParams(params interface{})
-	Invoke(monitor SyncStatusMonitor, parentCtx context.Context)
+	Invoke(monitor *SyncStatusMonitor, parentCtx context.Context)
 	Shutdown()
 }
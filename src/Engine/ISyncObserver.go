@@ -0,0 +1,16 @@
+package Engine
+
+import "time"
+
+/*
+Receives query and list engine events from a SyncStatusMonitor, e.g. for metrics.
+Methods are called while the monitor's lock is held, so they must be quick and must not call back into the monitor.
+*/
+type ISyncObserver interface {
+	// Called once when the list engine ends, after it has listed all of its servers (or failed)
+	OnServerListEngineEnd(engine IServerListEngine, stats ServerListEngineStats)
+
+	OnQuerySent(listEngine IServerListEngine, engine IQueryEngine, retry bool)
+	OnQueryResponse(listEngine IServerListEngine, engine IQueryEngine, rtt time.Duration)
+	OnQueryAbandoned(listEngine IServerListEngine, engine IQueryEngine)
+}
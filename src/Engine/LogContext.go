@@ -0,0 +1,39 @@
+package Engine
+
+import (
+	"log/slog"
+	"sync/atomic"
+)
+
+/*
+Embedded by engines and output handlers so they log with their pipeline's fields (pipeline, gamename
+and engine). The logger is set once the pipeline is configured, until then slog.Default() is used.
+Safe for concurrent use, UDP listeners may already be running when the logger is set.
+*/
+type LogContext struct {
+	logger atomic.Pointer[slog.Logger]
+}
+
+type ILogContext interface {
+	SetLogger(logger *slog.Logger)
+	Logger() *slog.Logger
+}
+
+func (l *LogContext) SetLogger(logger *slog.Logger) {
+	l.logger.Store(logger)
+}
+
+func (l *LogContext) Logger() *slog.Logger {
+	if logger := l.logger.Load(); logger != nil {
+		return logger
+	}
+	return slog.Default()
+}
+
+// The logger of an engine or output handler, slog.Default() if it doesn't embed a LogContext
+func GetLogger(component interface{}) *slog.Logger {
+	if context, ok := component.(ILogContext); ok {
+		return context.Logger()
+	}
+	return slog.Default()
+}
@@ -0,0 +1,268 @@
+package Engine
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	OUTPUT_QUEUE_SIZE    int           = 1024
+	OUTPUT_DRAIN_TIMEOUT time.Duration = 5 * time.Second
+)
+
+// An output handler and the name it was configured with
+type Output struct {
+	Name    string
+	Handler IQueryOutputHandler
+}
+
+type outputEventKind int
+
+const (
+	OUTPUT_EVENT_RESPONSE outputEventKind = iota
+	OUTPUT_EVENT_SERVER_TIMEOUT
+	OUTPUT_EVENT_LIST_ENGINE_COMPLETE
+	OUTPUT_EVENT_RUN_COMPLETE
+)
+
+func (k outputEventKind) String() string {
+	return [...]string{"response", "server_timeout", "list_engine_complete", "run_complete"}[k]
+}
+
+// A response or lifecycle callback queued for an output handler, only the fields of its kind are set
+type outputEvent struct {
+	kind          outputEventKind
+	sourceAddress net.Addr
+	info          *ServerInfo
+	address       netip.AddrPort
+	source        string
+	count         int
+	err           error
+	summary       RunSummary
+}
+
+// Events waiting for one output handler, given to it by its own goroutine
+type outputQueue struct {
+	output    Output
+	handler   IQueryOutputLifecycleHandler //output.Handler, adapted if it doesn't implement the lifecycle callbacks
+	responses chan outputEvent
+	pending   atomic.Int64
+	dropped   atomic.Uint64
+	full      atomic.Bool
+	done      chan struct{}
+}
+
+/*
+Dispatches query responses to every output handler of a pipeline. Each handler has a bounded queue
+and its own goroutine, so a slow or failing handler never blocks the others or the query engine's
+listen loop. When a handler's queue is full its responses and server timeouts are dropped and counted,
+the other lifecycle callbacks wait up to OUTPUT_DRAIN_TIMEOUT for room, or until Shutdown, before they
+are dropped too.
+*/
+type OutputFanOut struct {
+	LogContext
+
+	queues   []*outputQueue
+	mutex    sync.RWMutex
+	closed   bool
+	stopping chan struct{} //closed when Shutdown starts, so callbacks waiting for room give up
+	stopOnce sync.Once
+}
+
+func NewOutputFanOut(outputs []Output) *OutputFanOut {
+	var fanOut = &OutputFanOut{stopping: make(chan struct{})}
+	for _, output := range outputs {
+		var queue = &outputQueue{
+			output:    output,
+			handler:   AsLifecycleHandler(output.Handler),
+			responses: make(chan outputEvent, OUTPUT_QUEUE_SIZE),
+			done:      make(chan struct{}),
+		}
+		fanOut.queues = append(fanOut.queues, queue)
+		go fanOut.write(queue)
+	}
+	return fanOut
+}
+
+func (f *OutputFanOut) write(queue *outputQueue) {
+	defer close(queue.done)
+	for event := range queue.responses {
+		f.handleEvent(queue, event)
+		queue.pending.Add(-1)
+	}
+	f.flushHandler(queue) //the pipeline is shutting down
+}
+
+func (f *OutputFanOut) handleEvent(queue *outputQueue, event outputEvent) {
+	defer func() {
+		if err := recover(); err != nil {
+			f.Logger().Error("Output handler panicked", "output", queue.output.Name, "event", event.kind, "error", err)
+		}
+	}()
+
+	switch event.kind {
+	case OUTPUT_EVENT_RESPONSE:
+		WriteServerInfo(queue.output.Handler, event.sourceAddress, event.info)
+	case OUTPUT_EVENT_SERVER_TIMEOUT:
+		queue.handler.OnServerTimeout(event.address)
+	case OUTPUT_EVENT_LIST_ENGINE_COMPLETE:
+		queue.handler.OnListEngineComplete(event.source, event.count, event.err)
+	case OUTPUT_EVENT_RUN_COMPLETE:
+		queue.handler.OnRunComplete(event.summary)
+	}
+}
+
+func (f *OutputFanOut) flushHandler(queue *outputQueue) {
+	flusher, ok := queue.output.Handler.(IQueryOutputFlusher)
+	if !ok {
+		return
+	}
+	if err := flusher.Flush(); err != nil {
+		f.Logger().Error("Failed to flush output", "output", queue.output.Name, "error", err)
+	}
+}
+
+func (f *OutputFanOut) OnServerInfoResponse(sourceAddress net.Addr, serverProperties map[string]string) {
+	f.OnServerInfo(sourceAddress, &ServerInfo{Keys: serverProperties})
+}
+
+func (f *OutputFanOut) OnServerInfo(sourceAddress net.Addr, info *ServerInfo) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	if f.closed {
+		return
+	}
+
+	for _, queue := range f.queues {
+		//each handler gets its own copy, handlers may add keys to it
+		f.queueOrDrop(queue, outputEvent{kind: OUTPUT_EVENT_RESPONSE, sourceAddress: sourceAddress, info: info.Clone()})
+	}
+}
+
+// Caller must hold the read lock
+func (f *OutputFanOut) queueOrDrop(queue *outputQueue, event outputEvent) {
+	queue.pending.Add(1)
+	select {
+	case queue.responses <- event:
+		queue.full.Store(false)
+	default:
+		queue.pending.Add(-1)
+		queue.dropped.Add(1)
+		if queue.full.CompareAndSwap(false, true) {
+			f.Logger().Warn("Output queue full, dropping responses", "output", queue.output.Name, "queue_size", OUTPUT_QUEUE_SIZE)
+		}
+	}
+}
+
+// Queues the event for every handler, waiting for room in full queues until OUTPUT_DRAIN_TIMEOUT or Shutdown
+func (f *OutputFanOut) queueAll(event outputEvent) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	if f.closed {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), OUTPUT_DRAIN_TIMEOUT)
+	defer cancel()
+	for _, queue := range f.queues {
+		queue.pending.Add(1)
+		select {
+		case queue.responses <- event:
+			continue
+		case <-ctx.Done():
+		case <-f.stopping:
+		}
+		queue.pending.Add(-1)
+		queue.dropped.Add(1)
+		f.Logger().Warn("Output queue stayed full, dropping callback", "output", queue.output.Name, "event", event.kind)
+	}
+}
+
+func (f *OutputFanOut) OnServerTimeout(address netip.AddrPort) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	if f.closed {
+		return
+	}
+
+	for _, queue := range f.queues {
+		f.queueOrDrop(queue, outputEvent{kind: OUTPUT_EVENT_SERVER_TIMEOUT, address: address})
+	}
+}
+
+func (f *OutputFanOut) OnListEngineComplete(source string, count int, err error) {
+	f.queueAll(outputEvent{kind: OUTPUT_EVENT_LIST_ENGINE_COMPLETE, source: source, count: count, err: err})
+}
+
+// Handlers without OnRunComplete are flushed instead, see AsLifecycleHandler
+func (f *OutputFanOut) OnRunComplete(summary RunSummary) {
+	f.queueAll(outputEvent{kind: OUTPUT_EVENT_RUN_COMPLETE, summary: summary})
+}
+
+func (f *OutputFanOut) SetParams(params interface{}) {
+}
+
+// The handlers' counters added together, with the responses dropped from full queues
+func (f *OutputFanOut) GetOutputStats() OutputStats {
+	var stats OutputStats
+	for _, queue := range f.queues {
+		if provider, ok := queue.output.Handler.(IQueryOutputStatsProvider); ok {
+			var handlerStats = provider.GetOutputStats()
+			stats.Writes += handlerStats.Writes
+			stats.Errors += handlerStats.Errors
+		}
+		stats.Dropped += queue.dropped.Load()
+	}
+	return stats
+}
+
+func (f *OutputFanOut) getPending() int64 {
+	var pending int64
+	for _, queue := range f.queues {
+		pending += queue.pending.Load()
+	}
+	return pending
+}
+
+// Waits until every queued response has been written, returns false if ctx ends first
+func (f *OutputFanOut) WaitIdle(ctx context.Context) bool {
+	var ticker = time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for f.getPending() > 0 {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+	return true
+}
+
+// Stops accepting responses and gives the handlers up to OUTPUT_DRAIN_TIMEOUT to write what is queued
+func (f *OutputFanOut) Shutdown() {
+	f.stopOnce.Do(func() { close(f.stopping) }) //before locking, queueAll may be waiting with the read lock held
+	f.mutex.Lock()
+	if f.closed {
+		f.mutex.Unlock()
+		return
+	}
+	f.closed = true
+	for _, queue := range f.queues {
+		close(queue.responses)
+	}
+	f.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), OUTPUT_DRAIN_TIMEOUT)
+	defer cancel()
+	for _, queue := range f.queues {
+		select {
+		case <-queue.done:
+		case <-ctx.Done():
+			f.Logger().Warn("Output handler didn't finish writing before shutdown", "output", queue.output.Name, "pending", queue.pending.Load())
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package Engine
+
+import (
+	"errors"
+	"net/netip"
+	"time"
+)
+
+// What a sync cycle did for one pipeline, given to IQueryOutputLifecycle.OnRunComplete
+type RunSummary struct {
+	Pipeline      string
+	Started       time.Time
+	Finished      time.Time
+	ServersListed int
+	Responses     int
+	Abandoned     int
+	Error         error //why the server list failed or didn't finish, nil when it did
+}
+
+func NewRunSummary(pipeline string, stats ServerListEngineStats, invoked bool, cycleEnd time.Time) RunSummary {
+	var summary = RunSummary{
+		Pipeline:      pipeline,
+		Started:       stats.Started,
+		Finished:      stats.Finished,
+		ServersListed: stats.ServersListed,
+		Responses:     stats.Responses,
+		Abandoned:     stats.Abandoned,
+		Error:         stats.Error,
+	}
+	if summary.Finished.IsZero() {
+		summary.Finished = cycleEnd
+	}
+	if !invoked {
+		summary.Error = errors.New("server list engine was not invoked")
+	} else if summary.Error == nil && !stats.Ended {
+		summary.Error = errors.New("server list did not finish before the sync timeout")
+	}
+	return summary
+}
+
+// Embedded by output handlers which only need some of the lifecycle callbacks, the others do nothing
+type OutputLifecycleBase struct{}
+
+func (OutputLifecycleBase) OnServerTimeout(address netip.AddrPort) {
+}
+
+func (OutputLifecycleBase) OnListEngineComplete(source string, count int, err error) {
+}
+
+func (OutputLifecycleBase) OnRunComplete(summary RunSummary) {
+}
+
+// Gives an output handler without the lifecycle callbacks the behaviour it had before them
+type outputLifecycleAdapter struct {
+	IQueryOutputHandler
+	OutputLifecycleBase
+}
+
+// The end of a sync cycle is when handlers written before OnRunComplete existed expect to be flushed
+func (a *outputLifecycleAdapter) OnRunComplete(summary RunSummary) {
+	if flusher, ok := a.IQueryOutputHandler.(IQueryOutputFlusher); ok {
+		if err := flusher.Flush(); err != nil {
+			GetLogger(a.IQueryOutputHandler).Error("Failed to flush output", "error", err)
+		}
+	}
+}
+
+// Returns the handler itself if it implements the lifecycle callbacks, otherwise an adapter which ignores them
+func AsLifecycleHandler(handler IQueryOutputHandler) IQueryOutputLifecycleHandler {
+	if lifecycleHandler, ok := handler.(IQueryOutputLifecycleHandler); ok {
+		return lifecycleHandler
+	}
+	return &outputLifecycleAdapter{IQueryOutputHandler: handler}
+}
@@ -0,0 +1,21 @@
+package Engine
+
+// Cumulative write counters, reported by output handlers which implement IQueryOutputStatsProvider
+type OutputStats struct {
+	Writes  uint64
+	Errors  uint64
+	Dropped uint64 //responses never given to the handler, see OutputFanOut
+}
+
+type IQueryOutputStatsProvider interface {
+	GetOutputStats() OutputStats
+}
+
+// Difference between two snapshots of the same handler's counters, e.g. before and after a sync cycle
+func (s OutputStats) Sub(previous OutputStats) OutputStats {
+	return OutputStats{
+		Writes:  s.Writes - previous.Writes,
+		Errors:  s.Errors - previous.Errors,
+		Dropped: s.Dropped - previous.Dropped,
+	}
+}
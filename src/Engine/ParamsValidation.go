@@ -0,0 +1,208 @@
+package Engine
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+/*
+Params fields are checked according to their `validate` tag, a comma separated list of:
+  - required: must be set to a non-zero value
+  - hostport: a host:port address with a port between 1 and 65535
+  - url: an absolute http or https URL
+  - bindport: a local port to bind, 0 picks any free port. Non-zero ports must be unique across
+    the config unless every engine binding one shares it (see ISharedPortParams), which is checked
+    by the config loader using BindPorts
+  - nonnegative: a number which can't be below zero
+
+Fields which aren't required are only checked when they are set. On a list, required means it has at
+least one element and the other rules check each element.
+*/
+const VALIDATE_TAG = "validate"
+
+// A problem with a single params field, Field is its JSON name or empty for the params as a whole
+type ParamError struct {
+	Field   string
+	Message string
+}
+
+// Implemented by params structs which need checks the validate tags can't express
+type IParamsValidator interface {
+	ValidateParams() []ParamError
+}
+
+type paramsField struct {
+	name   string
+	rules  []string
+	secret bool
+	value  reflect.Value
+}
+
+// The fields of a params struct as they appear in the config, including those of embedded structs
+func getParamsFields(params interface{}) []paramsField {
+	var value = reflect.ValueOf(params)
+	for value.Kind() == reflect.Pointer || value.Kind() == reflect.Interface {
+		if value.IsNil() {
+			return nil
+		}
+		value = value.Elem()
+	}
+	if value.Kind() != reflect.Struct {
+		return nil
+	}
+	return getStructFields(value)
+}
+
+func getStructFields(value reflect.Value) []paramsField {
+	var fields []paramsField
+
+	var valueType = value.Type()
+	for i := 0; i < valueType.NumField(); i++ {
+		var field = valueType.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		if _, hasTag := field.Tag.Lookup("json"); field.Anonymous && !hasTag && field.Type.Kind() == reflect.Struct {
+			fields = append(fields, getStructFields(value.Field(i))...) //promoted, the same as encoding/json
+			continue
+		}
+
+		var name = getJSONName(field)
+		if name == "-" {
+			continue
+		}
+		var rules []string
+		if tag := field.Tag.Get(VALIDATE_TAG); len(tag) > 0 {
+			rules = strings.Split(tag, ",")
+		}
+		fields = append(fields, paramsField{name: name, rules: rules, secret: field.Tag.Get(SECRET_TAG) == "true", value: value.Field(i)})
+	}
+	return fields
+}
+
+func getJSONName(field reflect.StructField) string {
+	if tag, hasTag := field.Tag.Lookup("json"); hasTag {
+		tagName, _, _ := strings.Cut(tag, ",")
+		if len(tagName) > 0 {
+			return tagName
+		}
+	}
+	return field.Name
+}
+
+// Checks a params struct against its validate tags and IParamsValidator
+func ValidateParams(params interface{}) []ParamError {
+	var errors []ParamError
+
+	for _, field := range getParamsFields(params) {
+		if field.value.Kind() == reflect.Slice {
+			errors = append(errors, checkListRules(field)...)
+			continue
+		}
+		for _, rule := range field.rules {
+			if message := checkRule(rule, field.value); len(message) > 0 {
+				errors = append(errors, ParamError{Field: field.name, Message: message})
+				break
+			}
+		}
+	}
+
+	if validator, ok := params.(IParamsValidator); ok {
+		errors = append(errors, validator.ValidateParams()...)
+	}
+	return errors
+}
+
+// Returns the non-zero bindport fields of a params struct, by JSON name
+func BindPorts(params interface{}) map[string]int {
+	var ports = make(map[string]int)
+	for _, field := range getParamsFields(params) {
+		for _, rule := range field.rules {
+			if port := getInt(field.value); rule == "bindport" && port != 0 {
+				ports[field.name] = int(port)
+			}
+		}
+	}
+	return ports
+}
+
+func checkListRules(field paramsField) []ParamError {
+	var errors []ParamError
+	for _, rule := range field.rules {
+		if rule == "required" {
+			if field.value.Len() == 0 {
+				return []ParamError{{Field: field.name, Message: "is required"}}
+			}
+			continue
+		}
+		for i := 0; i < field.value.Len(); i++ {
+			if message := checkRule(rule, field.value.Index(i)); len(message) > 0 {
+				errors = append(errors, ParamError{Field: fmt.Sprintf("%s[%d]", field.name, i), Message: message})
+			}
+		}
+	}
+	return errors
+}
+
+func checkRule(rule string, value reflect.Value) string {
+	if rule != "required" && value.IsZero() {
+		return ""
+	}
+
+	switch rule {
+	case "required":
+		if value.IsZero() {
+			return "is required"
+		}
+	case "hostport":
+		return checkHostPort(value.String())
+	case "url":
+		parsed, err := url.Parse(value.String())
+		if err != nil {
+			return err.Error()
+		}
+		if (parsed.Scheme != "http" && parsed.Scheme != "https") || len(parsed.Host) == 0 {
+			return fmt.Sprintf("%q is not an http or https URL", value.String())
+		}
+	case "bindport":
+		if port := getInt(value); port < 0 || port > 65535 {
+			return fmt.Sprintf("port %d is out of range 0-65535", port)
+		}
+	case "nonnegative":
+		if (value.CanInt() && value.Int() < 0) || (value.CanFloat() && value.Float() < 0) {
+			return "can't be negative"
+		}
+	default:
+		return fmt.Sprintf("unknown validate rule %q", rule)
+	}
+	return ""
+}
+
+func checkHostPort(address string) string {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Sprintf("%q is not a host:port address", address)
+	}
+	if len(host) == 0 {
+		return fmt.Sprintf("%q is missing a host", address)
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil || port < 1 || port > 65535 {
+		return fmt.Sprintf("port %q is out of range 1-65535", portString)
+	}
+	return ""
+}
+
+func getInt(value reflect.Value) int64 {
+	if value.CanInt() {
+		return value.Int()
+	}
+	if value.CanUint() {
+		return int64(value.Uint())
+	}
+	return 0
+}
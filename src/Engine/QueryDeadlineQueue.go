@@ -0,0 +1,41 @@
+package Engine
+
+// Min-heap of pending queries ordered by the time their current attempt times out, used with container/heap
+type queryDeadlineQueue []*QueryEngineListItem
+
+func (q queryDeadlineQueue) Len() int {
+	return len(q)
+}
+
+func (q queryDeadlineQueue) Less(i, j int) bool {
+	return q[i].deadline.Before(q[j].deadline)
+}
+
+func (q queryDeadlineQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].queueIndex = i
+	q[j].queueIndex = j
+}
+
+func (q *queryDeadlineQueue) Push(x interface{}) {
+	var item = x.(*QueryEngineListItem)
+	item.queueIndex = len(*q)
+	*q = append(*q, item)
+}
+
+func (q *queryDeadlineQueue) Pop() interface{} {
+	var old = *q
+	var n = len(old)
+	var item = old[n-1]
+	old[n-1] = nil
+	item.queueIndex = -1
+	*q = old[:n-1]
+	return item
+}
+
+func (q queryDeadlineQueue) Peek() *QueryEngineListItem {
+	if len(q) == 0 {
+		return nil
+	}
+	return q[0]
+}
@@ -0,0 +1,102 @@
+package Engine
+
+import (
+	"container/list"
+	"net/netip"
+)
+
+/*
+Queries held back by a query engine's RateLimit, queued per /24 (or /64). Only subnets with a query waiting
+and an outstanding slot free are kept in the ready queue, so a /24 at MaxOutstandingPer24 costs nothing
+until one of its queries completes. Ready subnets take turns sending their oldest query.
+*/
+type queryWaitingQueue struct {
+	subnets        map[netip.Prefix]*subnetQueue
+	ready          *list.List //of *subnetQueue
+	perSubnetLimit int        //zero means unlimited
+}
+
+type subnetQueue struct {
+	prefix       netip.Prefix
+	outstanding  int
+	waiting      *list.List    //of *QueryEngineListItem, in the order they were listed
+	readyElement *list.Element //set while in the ready queue
+}
+
+func newQueryWaitingQueue() *queryWaitingQueue {
+	return &queryWaitingQueue{subnets: make(map[netip.Prefix]*subnetQueue), ready: list.New()}
+}
+
+func (q *queryWaitingQueue) setPerSubnetLimit(limit int) {
+	q.perSubnetLimit = limit
+	for _, subnet := range q.subnets {
+		q.update(subnet)
+	}
+}
+
+func (q *queryWaitingQueue) getSubnetQueue(address netip.AddrPort) *subnetQueue {
+	var prefix = getSubnet(address)
+	subnet, exists := q.subnets[prefix]
+	if !exists {
+		subnet = &subnetQueue{prefix: prefix, waiting: list.New()}
+		q.subnets[prefix] = subnet
+	}
+	return subnet
+}
+
+func (q *queryWaitingQueue) push(queryItem *QueryEngineListItem) {
+	var subnet = q.getSubnetQueue(queryItem.address)
+	queryItem.waitingElement = subnet.waiting.PushBack(queryItem)
+	q.update(subnet)
+}
+
+// Removes a query which is still waiting
+func (q *queryWaitingQueue) remove(queryItem *QueryEngineListItem) {
+	var subnet = q.getSubnetQueue(queryItem.address)
+	subnet.waiting.Remove(queryItem.waitingElement)
+	queryItem.waitingElement = nil
+	q.update(subnet)
+}
+
+func (q *queryWaitingQueue) hasReady() bool {
+	return q.ready.Len() > 0
+}
+
+// Takes the next query which can be sent and counts it as outstanding, nil if none can
+func (q *queryWaitingQueue) pop() *QueryEngineListItem {
+	var front = q.ready.Front()
+	if front == nil {
+		return nil
+	}
+	var subnet = front.Value.(*subnetQueue)
+	q.ready.Remove(front)
+	subnet.readyElement = nil
+
+	var queryItem = subnet.waiting.Remove(subnet.waiting.Front()).(*QueryEngineListItem)
+	queryItem.waitingElement = nil
+	subnet.outstanding++
+	q.update(subnet) //back of the ready queue if it can send another
+	return queryItem
+}
+
+// Frees the outstanding slot of a sent query
+func (q *queryWaitingQueue) release(address netip.AddrPort) {
+	var subnet = q.getSubnetQueue(address)
+	subnet.outstanding--
+	q.update(subnet)
+}
+
+// Adds the subnet to or removes it from the ready queue, and forgets it once it has nothing waiting or outstanding
+func (q *queryWaitingQueue) update(subnet *subnetQueue) {
+	var ready = subnet.waiting.Len() > 0 && (q.perSubnetLimit <= 0 || subnet.outstanding < q.perSubnetLimit)
+	if ready && subnet.readyElement == nil {
+		subnet.readyElement = q.ready.PushBack(subnet)
+	} else if !ready && subnet.readyElement != nil {
+		q.ready.Remove(subnet.readyElement)
+		subnet.readyElement = nil
+	}
+
+	if subnet.waiting.Len() == 0 && subnet.outstanding <= 0 {
+		delete(q.subnets, subnet.prefix)
+	}
+}
@@ -0,0 +1,69 @@
+package Engine
+
+import (
+	"net/netip"
+	"time"
+)
+
+/*
+Per query engine outbound pacing, set from the "rate_limit" block of a QueryEngine in the config. Zero means unlimited.
+PacketsPerSecond counts packets rather than queries, engines sending several packets per query say so with IQueryPacketCounter.
+*/
+type RateLimit struct {
+	PacketsPerSecond    int `json:"packets_per_second" validate:"nonnegative"`
+	MaxOutstanding      int `json:"max_outstanding" validate:"nonnegative"`
+	MaxOutstandingPer24 int `json:"max_outstanding_per_24" validate:"nonnegative"` //outstanding queries to the same /24 (or /64 for IPv6)
+}
+
+// Token bucket, refilled at PacketsPerSecond and holding about one THINK_INTERVAL worth of packets
+type rateLimiter struct {
+	limit      RateLimit
+	tokens     float64
+	lastRefill time.Time
+}
+
+func (r *rateLimiter) capacity() float64 {
+	//+1 so the fraction left over between thinks isn't lost to the cap
+	return float64(r.limit.PacketsPerSecond)*THINK_INTERVAL.Seconds() + 1
+}
+
+// Takes a query's packets from the bucket, a query is let through once a token is left even if it has more packets than that
+func (r *rateLimiter) takeTokens(now time.Time, packets int) bool {
+	if r.limit.PacketsPerSecond <= 0 {
+		return true
+	}
+
+	if r.lastRefill.IsZero() {
+		r.tokens = r.capacity()
+	} else {
+		r.tokens += now.Sub(r.lastRefill).Seconds() * float64(r.limit.PacketsPerSecond)
+		if r.tokens > r.capacity() {
+			r.tokens = r.capacity()
+		}
+	}
+	r.lastRefill = now
+
+	if r.tokens < 1 {
+		return false
+	}
+	r.tokens -= float64(packets) //may go below zero, the refill pays it back before the next query
+	return true
+}
+
+// Packets the engine sends for each query
+func getPacketsPerQuery(engine IQueryEngine) int {
+	if counter, ok := engine.(IQueryPacketCounter); ok && counter.PacketsPerQuery() > 0 {
+		return counter.PacketsPerQuery()
+	}
+	return 1
+}
+
+func getSubnet(address netip.AddrPort) netip.Prefix {
+	var addr = NormalizeAddrPort(address).Addr()
+	var bits = 24
+	if addr.Is6() {
+		bits = 64
+	}
+	prefix, _ := addr.Prefix(bits)
+	return prefix
+}
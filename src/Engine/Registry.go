@@ -0,0 +1,144 @@
+package Engine
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/*
+An engine or output handler available to the config by name.
+NewParams returns a pointer to a new, zero params struct for the config's "params" object to be
+decoded into, which is then passed to SetParams of the value returned by New.
+*/
+type Registration[T any] struct {
+	Name      string
+	NewParams func() interface{}
+	New       func() T
+}
+
+// A params struct field as it appears in the config
+type ParamField struct {
+	Name   string
+	Type   string
+	Rules  string //the field's validate tag
+	Secret bool   //accepts ${ENV} and file: references
+}
+
+type registry[T any] struct {
+	kind    string
+	mutex   sync.RWMutex
+	entries map[string]Registration[T]
+}
+
+var (
+	serverListEngines = &registry[IServerListEngine]{kind: "server list engine"}
+	queryEngines      = &registry[IQueryEngine]{kind: "query engine"}
+	outputHandlers    = &registry[IQueryOutputHandler]{kind: "output handler"}
+)
+
+func (r *registry[T]) register(name string, newParams func() interface{}, newEngine func() T) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.entries == nil {
+		r.entries = make(map[string]Registration[T])
+	}
+	if _, exists := r.entries[name]; exists {
+		panic(fmt.Sprintf("%s %q registered twice", r.kind, name))
+	}
+	r.entries[name] = Registration[T]{Name: name, NewParams: newParams, New: newEngine}
+}
+
+func (r *registry[T]) lookup(name string) (Registration[T], error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	registration, exists := r.entries[name]
+	if !exists {
+		return Registration[T]{}, fmt.Errorf("unknown %s %q", r.kind, name)
+	}
+	return registration, nil
+}
+
+func (r *registry[T]) list() []Registration[T] {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	var registrations []Registration[T]
+	for _, registration := range r.entries {
+		registrations = append(registrations, registration)
+	}
+	sort.Slice(registrations, func(i, j int) bool {
+		return registrations[i].Name < registrations[j].Name
+	})
+	return registrations
+}
+
+// Engine packages register themselves from init(), a name can only be registered once per kind
+func RegisterServerListEngine(name string, newParams func() interface{}, newEngine func() IServerListEngine) {
+	serverListEngines.register(name, newParams, newEngine)
+}
+
+func RegisterQueryEngine(name string, newParams func() interface{}, newEngine func() IQueryEngine) {
+	queryEngines.register(name, newParams, newEngine)
+}
+
+func RegisterOutputHandler(name string, newParams func() interface{}, newHandler func() IQueryOutputHandler) {
+	outputHandlers.register(name, newParams, newHandler)
+}
+
+func LookupServerListEngine(name string) (Registration[IServerListEngine], error) {
+	return serverListEngines.lookup(name)
+}
+
+func LookupQueryEngine(name string) (Registration[IQueryEngine], error) {
+	return queryEngines.lookup(name)
+}
+
+func LookupOutputHandler(name string) (Registration[IQueryOutputHandler], error) {
+	return outputHandlers.lookup(name)
+}
+
+// Registered engines and handlers, sorted by name
+func ServerListEngines() []Registration[IServerListEngine] {
+	return serverListEngines.list()
+}
+
+func QueryEngines() []Registration[IQueryEngine] {
+	return queryEngines.list()
+}
+
+func OutputHandlers() []Registration[IQueryOutputHandler] {
+	return outputHandlers.list()
+}
+
+// Describes the fields of the registration's params struct, using their JSON names
+func (r Registration[T]) ParamsSchema() []ParamField {
+	var fields []ParamField
+	for _, field := range getParamsFields(r.NewParams()) {
+		fields = append(fields, ParamField{
+			Name:   field.name,
+			Type:   describeType(field.value.Type()),
+			Rules:  strings.Join(field.rules, ","),
+			Secret: field.secret,
+		})
+	}
+	return fields
+}
+
+func describeType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Interface:
+		return "any"
+	case reflect.Map, reflect.Struct:
+		return "object"
+	case reflect.Slice, reflect.Array:
+		return "[]" + describeType(t.Elem())
+	case reflect.Pointer:
+		return describeType(t.Elem())
+	}
+	return t.Kind().String()
+}
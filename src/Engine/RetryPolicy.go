@@ -0,0 +1,58 @@
+package Engine
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+const (
+	MAX_ATTEMPTS  int = 5  //default number of times a query is sent before it is abandoned
+	RETRY_SECONDS     = 30 //default time to wait for a response before re-sending
+)
+
+// Per query engine retry settings, set from the "retry" block of a QueryEngine in the config
+type RetryPolicy struct {
+	Attempts          int     `json:"attempts" validate:"nonnegative"`
+	InitialTimeoutMs  int     `json:"initial_timeout_ms" validate:"nonnegative"`
+	BackoffMultiplier float64 `json:"backoff_multiplier" validate:"nonnegative"`
+	JitterMs          int     `json:"jitter_ms" validate:"nonnegative"`
+	MaxTimeoutMs      int     `json:"max_timeout_ms" validate:"nonnegative"`
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		Attempts:          MAX_ATTEMPTS,
+		InitialTimeoutMs:  RETRY_SECONDS * 1000,
+		BackoffMultiplier: 1.0,
+	}
+}
+
+// Fills any unset fields from DefaultRetryPolicy
+func (p RetryPolicy) WithDefaults() RetryPolicy {
+	var defaults = DefaultRetryPolicy()
+	if p.Attempts <= 0 {
+		p.Attempts = defaults.Attempts
+	}
+	if p.InitialTimeoutMs <= 0 {
+		p.InitialTimeoutMs = defaults.InitialTimeoutMs
+	}
+	if p.BackoffMultiplier < 1.0 {
+		p.BackoffMultiplier = defaults.BackoffMultiplier
+	}
+	return p
+}
+
+// How long to wait for a response to the given attempt (1 being the first send) before retrying or abandoning
+func (p RetryPolicy) Timeout(attempt int) time.Duration {
+	var timeoutMs = float64(p.InitialTimeoutMs) * math.Pow(p.BackoffMultiplier, float64(attempt-1))
+	if p.MaxTimeoutMs > 0 && timeoutMs > float64(p.MaxTimeoutMs) {
+		timeoutMs = float64(p.MaxTimeoutMs)
+	}
+
+	var timeout = time.Duration(timeoutMs) * time.Millisecond
+	if p.JitterMs > 0 {
+		timeout += time.Duration(rand.Intn(p.JitterMs)) * time.Millisecond
+	}
+	return timeout
+}
@@ -0,0 +1,64 @@
+package Engine
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+/*
+String params tagged `secret:"true"` may reference their value instead of holding it, so the config
+can be kept in git:
+  - ${NAME} is replaced by the environment variable NAME, which must be set
+  - file:/path/to/secret is replaced by the contents of the file, without its trailing newline
+*/
+const (
+	SECRET_TAG         = "secret"
+	SECRET_FILE_PREFIX = "file:"
+)
+
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// Replaces the references in the secret fields of a params struct with their values
+func ResolveSecrets(params interface{}) []ParamError {
+	var errors []ParamError
+
+	for _, field := range getParamsFields(params) {
+		if !field.secret || field.value.Kind() != reflect.String || !field.value.CanSet() {
+			continue
+		}
+		resolved, err := resolveSecret(field.value.String())
+		if err != nil {
+			errors = append(errors, ParamError{Field: field.name, Message: err.Error()})
+			continue
+		}
+		field.value.SetString(resolved)
+	}
+	return errors
+}
+
+func resolveSecret(value string) (string, error) {
+	if path, isFile := strings.CutPrefix(value, SECRET_FILE_PREFIX); isFile {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read secret file: %w", err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+
+	var missing []string
+	var resolved = envReference.ReplaceAllStringFunc(value, func(reference string) string {
+		var name = envReference.FindStringSubmatch(reference)[1]
+		envValue, exists := os.LookupEnv(name)
+		if !exists {
+			missing = append(missing, name)
+		}
+		return envValue
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("environment variable %s is not set", strings.Join(missing, ", "))
+	}
+	return resolved, nil
+}
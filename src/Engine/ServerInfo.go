@@ -0,0 +1,110 @@
+package Engine
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A server's response to a query, each query engine fills in what its protocol provides
+type ServerInfo struct {
+	Protocol string            //the query engine's protocol, e.g. "qr2"
+	RTT      time.Duration     //since the answered attempt was sent, zero when unknown
+	Keys     map[string]string //what OnServerInfoResponse is given, including keys the query engine calculates
+	Players  []PlayerInfo
+	Teams    []TeamInfo
+	Rules    map[string]string //every key as the server sent it, nil when its protocol only has fixed fields
+}
+
+type PlayerInfo struct {
+	Name  string            `json:"name"`
+	Score int               `json:"score"`
+	Ping  int               `json:"ping"`
+	Team  int               `json:"team"`           //index into Teams, -1 when not reported
+	Keys  map[string]string `json:"keys,omitempty"` //every key the server sent for the player, named as QR2 does (player_, score_)
+}
+
+type TeamInfo struct {
+	Name  string            `json:"name"`
+	Score int               `json:"score"`
+	Keys  map[string]string `json:"keys,omitempty"` //named as QR2 does (team_t, score_t)
+}
+
+func NewPlayerInfo() *PlayerInfo {
+	return &PlayerInfo{Team: -1, Keys: make(map[string]string)}
+}
+
+// Keeps a key the server sent for the player, also setting the field it maps to
+func (p *PlayerInfo) SetKey(name string, value string) {
+	p.Keys[name] = value
+	switch strings.TrimSuffix(name, "_") {
+	case "player", "playername", "name":
+		p.Name = value
+	case "frags", "score":
+		p.Score, _ = strconv.Atoi(value)
+	case "ping":
+		p.Ping, _ = strconv.Atoi(value)
+	case "team":
+		if team, err := strconv.Atoi(value); err == nil {
+			p.Team = team
+		}
+	}
+}
+
+func NewTeamInfo() *TeamInfo {
+	return &TeamInfo{Keys: make(map[string]string)}
+}
+
+// Keeps a key the server sent for the team, also setting the field it maps to
+func (t *TeamInfo) SetKey(name string, value string) {
+	t.Keys[name] = value
+	switch strings.TrimSuffix(name, "_t") {
+	case "team", "name":
+		t.Name = value
+	case "score":
+		t.Score, _ = strconv.Atoi(value)
+	}
+}
+
+// A copy sharing nothing with the original, for handlers which may change it
+func (s *ServerInfo) Clone() *ServerInfo {
+	var clone = *s
+	clone.Keys = cloneKeys(s.Keys)
+	clone.Rules = cloneKeys(s.Rules)
+	if s.Players != nil {
+		clone.Players = make([]PlayerInfo, len(s.Players))
+		for i, player := range s.Players {
+			player.Keys = cloneKeys(player.Keys)
+			clone.Players[i] = player
+		}
+	}
+	if s.Teams != nil {
+		clone.Teams = make([]TeamInfo, len(s.Teams))
+		for i, team := range s.Teams {
+			team.Keys = cloneKeys(team.Keys)
+			clone.Teams[i] = team
+		}
+	}
+	return &clone
+}
+
+func cloneKeys(keys map[string]string) map[string]string {
+	if keys == nil {
+		return nil
+	}
+	var clone = make(map[string]string, len(keys))
+	for k, v := range keys {
+		clone[k] = v
+	}
+	return clone
+}
+
+// Gives a response to an output handler, as a ServerInfo when it implements IServerInfoOutputHandler and otherwise as its Keys
+func WriteServerInfo(handler IQueryOutputHandler, sourceAddress net.Addr, info *ServerInfo) {
+	if infoHandler, ok := handler.(IServerInfoOutputHandler); ok {
+		infoHandler.OnServerInfo(sourceAddress, info)
+		return
+	}
+	handler.OnServerInfoResponse(sourceAddress, info.Keys)
+}
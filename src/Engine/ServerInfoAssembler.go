@@ -0,0 +1,100 @@
+package Engine
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	SERVER_INFO_ASSEMBLY_TIMEOUT = 500 * time.Millisecond //how long a server's other responses are waited for once the first arrives
+)
+
+/*
+Merges the responses to the separate info, rules and player queries some protocols need into one
+ServerInfo per server. A server's info is completed as soon as isComplete says every part has arrived,
+or SERVER_INFO_ASSEMBLY_TIMEOUT after its first response with whatever did, so a server which ignores
+one of the queries is still written. Protocols which can't tell when a split part has ended pass a nil
+isComplete, their servers are always completed by the timeout. Info without any Keys (the basic info never arrived) is dropped
+then, the monitor retries the query.
+
+Safe for concurrent use, complete is called without the lock held, from the goroutine adding the last
+part or from the timer's.
+*/
+type ServerInfoAssembler struct {
+	mutex      sync.Mutex
+	protocol   string
+	pending    map[netip.AddrPort]*serverInfoAssembly
+	isComplete func(info *ServerInfo, received map[string]bool) bool
+	complete   func(address netip.AddrPort, info *ServerInfo)
+}
+
+type serverInfoAssembly struct {
+	info     *ServerInfo
+	received map[string]bool //parts added so far
+	timer    *time.Timer
+}
+
+func NewServerInfoAssembler(protocol string, isComplete func(info *ServerInfo, received map[string]bool) bool, complete func(address netip.AddrPort, info *ServerInfo)) *ServerInfoAssembler {
+	return &ServerInfoAssembler{
+		protocol:   protocol,
+		pending:    make(map[netip.AddrPort]*serverInfoAssembly),
+		isComplete: isComplete,
+		complete:   complete,
+	}
+}
+
+// Merges a response into the server's info, parts split over several packets are added once per packet
+func (a *ServerInfoAssembler) Add(address netip.AddrPort, part string, merge func(info *ServerInfo)) {
+	var key = NormalizeAddrPort(address)
+
+	a.mutex.Lock()
+	assembly, exists := a.pending[key]
+	if !exists {
+		assembly = &serverInfoAssembly{
+			info:     &ServerInfo{Protocol: a.protocol, Keys: make(map[string]string)},
+			received: make(map[string]bool),
+		}
+		assembly.timer = time.AfterFunc(SERVER_INFO_ASSEMBLY_TIMEOUT, func() {
+			a.expire(key, assembly)
+		})
+		a.pending[key] = assembly
+	}
+
+	merge(assembly.info)
+	assembly.received[part] = true
+	if a.isComplete == nil || !a.isComplete(assembly.info, assembly.received) {
+		a.mutex.Unlock()
+		return
+	}
+	assembly.timer.Stop()
+	delete(a.pending, key)
+	a.mutex.Unlock()
+
+	a.complete(key, assembly.info)
+}
+
+func (a *ServerInfoAssembler) expire(key netip.AddrPort, assembly *serverInfoAssembly) {
+	a.mutex.Lock()
+	if a.pending[key] != assembly { //completed in the meantime
+		a.mutex.Unlock()
+		return
+	}
+	delete(a.pending, key)
+	a.mutex.Unlock()
+
+	if len(assembly.info.Keys) > 0 {
+		a.complete(key, assembly.info)
+	}
+}
+
+// Drops every server's partial info without completing it
+func (a *ServerInfoAssembler) Clear() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for key, assembly := range a.pending {
+		assembly.timer.Stop()
+		delete(a.pending, key)
+	}
+}
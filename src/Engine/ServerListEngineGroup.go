@@ -0,0 +1,44 @@
+package Engine
+
+import "context"
+
+// A server list engine and the name it was configured with
+type ServerListSource struct {
+	Name   string
+	Engine IServerListEngine
+}
+
+/*
+Runs several server list engines as the sources of one pipeline. The monitor reports their servers as
+the group's, and a server listed by more than one source is only queried once.
+*/
+type ServerListEngineGroup struct {
+	sources []ServerListSource
+}
+
+func NewServerListEngineGroup(sources []ServerListSource) *ServerListEngineGroup {
+	return &ServerListEngineGroup{sources: sources}
+}
+
+func (g *ServerListEngineGroup) SetQueryEngine(engine IQueryEngine) {
+	for _, source := range g.sources {
+		source.Engine.SetQueryEngine(engine)
+	}
+}
+
+// The sources are configured individually
+func (g *ServerListEngineGroup) SetParams(params interface{}) {
+}
+
+func (g *ServerListEngineGroup) Invoke(monitor *SyncStatusMonitor, parentCtx context.Context) {
+	monitor.BeginServerListEngineGroup(g, g.sources)
+	for _, source := range g.sources {
+		source.Engine.Invoke(monitor, parentCtx)
+	}
+}
+
+func (g *ServerListEngineGroup) Shutdown() {
+	for _, source := range g.sources {
+		source.Engine.Shutdown()
+	}
+}
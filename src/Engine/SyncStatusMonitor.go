@@ -1,9 +1,13 @@
 package Engine
 
 import (
+	"container/heap"
 	"container/list"
-	"log"
+	"context"
+	"errors"
 	"net/netip"
+	"sort"
+	"sync"
 	"time"
 )
 
@@ -13,113 +17,582 @@ type QueryEngineListItem struct {
 	listEngine    IServerListEngine
 	lastPerformed time.Time
 	numAttempts   int
+	listed        time.Time
+
+	deadline       time.Time     //when the current attempt times out
+	queueIndex     int           //position in the retry queue, maintained by queryDeadlineQueue
+	waitingElement *list.Element //set while held back by the query engine's RateLimit
 }
 
 const (
-	MAX_ATTEMPTS  int = 5
-	RETRY_SECONDS     = 30
+	THINK_INTERVAL = 250 * time.Millisecond //how often Think should be called
 )
 
+type queryKey struct {
+	engine  IQueryEngine
+	address netip.AddrPort
+}
+
+// Counters for a single list engine over one sync cycle, used for the run report
+type ServerListEngineStats struct {
+	Started       time.Time
+	ListEnded     time.Time //when the list engine ended, zero until then
+	Finished      time.Time //zero until the list has ended and all of its queries completed or were abandoned
+	Ended         bool
+	Error         error //first error the list engine ended with
+	ServersListed int
+	QueriesSent   int //including retries
+	Responses     int
+	Retries       int
+	Abandoned     int
+	Pending       int //listed servers which haven't responded or been abandoned yet
+
+	Sources  []SourceStats               //one per source of a ServerListEngineGroup, in config order
+	ListedBy map[netip.AddrPort][]string //the sources which listed each server, only kept for groups
+}
+
+// Counters for one source of a ServerListEngineGroup
+type SourceStats struct {
+	Name          string
+	ServersListed int //including servers another source listed first
+	Ended         bool
+	Error         error
+}
+
+// A list engine invoked as a source of a ServerListEngineGroup
+type groupSource struct {
+	group IServerListEngine
+	index int //into the group's Sources
+}
+
+// Where a list engine's lifecycle events go, see SetOutput
+type listOutput struct {
+	name   string
+	output IQueryOutputLifecycle
+}
+
+// A source which ended, to be given to its output once the lock is released
+type listCompletion struct {
+	output IQueryOutputLifecycle
+	source string
+	count  int
+	err    error
+}
+
+// A query which hasn't been answered or abandoned yet, as shown by the status endpoint
+type PendingQueryStatus struct {
+	Address  netip.AddrPort
+	Engine   IQueryEngine
+	Attempts int           //zero while held back by the rate limit
+	Age      time.Duration //since the server was listed
+}
+
+// Per query engine settings and rate limiting state
+type queryEngineState struct {
+	retryPolicy     RetryPolicy
+	limiter         rateLimiter
+	packetsPerQuery int //charged to the limiter for each query sent
+	outstanding     int
+	waiting         *queryWaitingQueue //queries not yet sent, and the outstanding count of each /24
+}
+
+/*
+Tracks the server list engines and outstanding queries of a single sync cycle.
+
+The monitor is shared by pointer between the list engines, the query engine UDP listeners and the
+Think ticker, so every exported method is safe for concurrent use:
+  - BeginQuery registers a query and sends it, returning false if the same engine already has a
+    query pending for that address
+  - CompleteQuery removes a pending query, unknown or already completed queries are ignored
+  - Think re-sends timed out queries and abandons those out of attempts according to the query engine's
+    RetryPolicy, queries are sent without holding the lock
+  - AllEnginesComplete is true once every list engine has ended and no queries are pending
+  - abandoned queries and ended sources are given to the list engine's output (see SetOutput) after
+    the lock is released
+
+Queries which would exceed the query engine's RateLimit are held in a waiting queue and sent as
+responses arrive, queries are abandoned or the packet rate allows.
+
+Pending queries are indexed by (query engine, address) and kept in a deadline ordered retry queue,
+so BeginQuery and CompleteQuery are O(log n) and Think only visits queries which have timed out.
+*/
 type SyncStatusMonitor struct {
-	serverEngineList *list.List
-	queryList        *list.List
+	mutex         sync.Mutex
+	serverEngines map[IServerListEngine]struct{}
+	queries       map[queryKey]*QueryEngineListItem
+	retryQueue    queryDeadlineQueue
+	queryEngines  map[IQueryEngine]*queryEngineState
+	listStats     map[IServerListEngine]*ServerListEngineStats
+	groupSources  map[IServerListEngine]groupSource
+	outputs       map[IServerListEngine]listOutput
+	observer      ISyncObserver
 }
 
 func (m *SyncStatusMonitor) Init() {
-	m.serverEngineList = list.New()
-	m.queryList = list.New()
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.serverEngines = make(map[IServerListEngine]struct{})
+	m.queries = make(map[queryKey]*QueryEngineListItem)
+	m.retryQueue = nil
+	m.queryEngines = make(map[IQueryEngine]*queryEngineState)
+	m.listStats = make(map[IServerListEngine]*ServerListEngineStats)
+	m.groupSources = make(map[IServerListEngine]groupSource)
+	m.outputs = make(map[IServerListEngine]listOutput)
+}
+
+func (m *SyncStatusMonitor) SetObserver(observer ISyncObserver) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.observer = observer
+}
+
+// Sets the output told about the list engine's timed out servers and ended sources, name is used for a list engine which isn't a group
+func (m *SyncStatusMonitor) SetOutput(listEngine IServerListEngine, name string, output IQueryOutputLifecycle) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.outputs[listEngine] = listOutput{name: name, output: output}
+}
+
+// Query engines without a policy set use DefaultRetryPolicy
+func (m *SyncStatusMonitor) SetRetryPolicy(engine IQueryEngine, policy RetryPolicy) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.getQueryEngineState(engine).retryPolicy = policy.WithDefaults()
+}
+
+// Query engines without a limit set send every query as soon as it is listed
+func (m *SyncStatusMonitor) SetRateLimit(engine IQueryEngine, limit RateLimit) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var state = m.getQueryEngineState(engine)
+	state.limiter.limit = limit
+	state.waiting.setPerSubnetLimit(limit.MaxOutstandingPer24)
+}
+
+// Caller must hold the mutex
+func (m *SyncStatusMonitor) getQueryEngineState(engine IQueryEngine) *queryEngineState {
+	state, exists := m.queryEngines[engine]
+	if !exists {
+		state = &queryEngineState{}
+		state.retryPolicy = DefaultRetryPolicy()
+		state.packetsPerQuery = getPacketsPerQuery(engine)
+		state.waiting = newQueryWaitingQueue()
+		m.queryEngines[engine] = state
+	}
+	return state
 }
 
 func (m *SyncStatusMonitor) BeginServerListEngine(engine IServerListEngine) {
-	m.serverEngineList.PushFront(engine)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, isSource := m.groupSources[engine]; isSource { //the group began when it was invoked
+		return
+	}
+	m.serverEngines[engine] = struct{}{}
+	m.listStats[engine] = &ServerListEngineStats{Started: time.Now()}
+}
+
+/*
+Safe to call more than once, list engines end both on error and when their context is done.
+err is the reason the list engine stopped (usually context.Cause of its context), the first
+non-nil error is kept for the run report. context.Canceled is treated as a normal finish.
+*/
+func (m *SyncStatusMonitor) EndServerListEngine(engine IServerListEngine, err error) {
+	m.mutex.Lock()
+	var completion *listCompletion
+	if source, isSource := m.groupSources[engine]; isSource {
+		completion = m.endGroupSource(source, err)
+	} else {
+		completion = m.endServerListEngine(engine, err)
+	}
+	m.mutex.Unlock()
+
+	if completion != nil {
+		completion.output.OnListEngineComplete(completion.source, completion.count, completion.err)
+	}
+}
+
+// Caller must hold the mutex. Returns the completion to give the list engine's output the first time it ends
+func (m *SyncStatusMonitor) endServerListEngine(engine IServerListEngine, err error) *listCompletion {
+	delete(m.serverEngines, engine)
+
+	var completion *listCompletion
+	var stats = m.getListStats(engine)
+	if err != nil && !errors.Is(err, context.Canceled) && stats.Error == nil {
+		stats.Error = err
+	}
+	if !stats.Ended {
+		stats.Ended = true
+		stats.ListEnded = time.Now()
+		if m.observer != nil {
+			m.observer.OnServerListEngineEnd(engine, *stats)
+		}
+		if output, hasOutput := m.outputs[engine]; hasOutput {
+			completion = &listCompletion{output.output, output.name, stats.ServersListed, stats.Error}
+		}
+	}
+	m.checkListFinished(stats)
+	return completion
 }
 
-func (m *SyncStatusMonitor) EndServerListEngine(engine IServerListEngine) {
-	for element := m.serverEngineList.Front(); element != nil; element = element.Next() {
-		var c IServerListEngine = element.Value.(IServerListEngine)
-		if c == engine {
-			m.serverEngineList.Remove(element)
+/*
+Registers the sources of a ServerListEngineGroup, which then report to the monitor as the group: their
+servers are counted once in the group's stats however many sources list them, and the group ends once
+every source has. The group only fails if all of its sources did.
+*/
+func (m *SyncStatusMonitor) BeginServerListEngineGroup(group IServerListEngine, sources []ServerListSource) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.serverEngines[group] = struct{}{}
+	var stats = &ServerListEngineStats{Started: time.Now(), ListedBy: make(map[netip.AddrPort][]string)}
+	for i, source := range sources {
+		m.groupSources[source.Engine] = groupSource{group: group, index: i}
+		stats.Sources = append(stats.Sources, SourceStats{Name: source.Name})
+	}
+	m.listStats[group] = stats
+}
+
+// Caller must hold the mutex. Returns the completion to give the group's output the first time the source ends
+func (m *SyncStatusMonitor) endGroupSource(source groupSource, err error) *listCompletion {
+	var stats = m.getListStats(source.group)
+	var sourceStats = &stats.Sources[source.index]
+	if err != nil && !errors.Is(err, context.Canceled) && sourceStats.Error == nil {
+		sourceStats.Error = err
+	}
+	if sourceStats.Ended {
+		return nil
+	}
+	sourceStats.Ended = true
+
+	var completion *listCompletion
+	if output, hasOutput := m.outputs[source.group]; hasOutput {
+		completion = &listCompletion{output.output, sourceStats.Name, sourceStats.ServersListed, sourceStats.Error}
+	}
+
+	for _, other := range stats.Sources {
+		if !other.Ended {
+			return completion
 		}
 	}
+
+	var groupErr error
+	for _, other := range stats.Sources {
+		if other.Error == nil { //at least one source listed its servers
+			groupErr = nil
+			break
+		}
+		if groupErr == nil {
+			groupErr = other.Error
+		}
+	}
+	m.endServerListEngine(source.group, groupErr) //the group's own completion isn't given, its sources' were
+	return completion
 }
-func (m *SyncStatusMonitor) engineHasPendingQueries(listEngine IServerListEngine) bool {
-	for element := m.queryList.Front(); element != nil; element = element.Next() {
-		var c *QueryEngineListItem = element.Value.(*QueryEngineListItem)
-		if c.listEngine == listEngine {
-			return true
+
+// Returns a copy of the counters for the given list engine, false if it was never invoked with this monitor
+func (m *SyncStatusMonitor) GetServerListEngineStats(engine IServerListEngine) (ServerListEngineStats, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	stats, exists := m.listStats[engine]
+	if !exists {
+		return ServerListEngineStats{}, false
+	}
+
+	var copied = *stats
+	if stats.Sources != nil {
+		copied.Sources = append([]SourceStats(nil), stats.Sources...)
+		copied.ListedBy = make(map[netip.AddrPort][]string, len(stats.ListedBy))
+		for address, sources := range stats.ListedBy {
+			copied.ListedBy[address] = append([]string(nil), sources...)
 		}
 	}
-	return false
+	return copied, true
 }
+
+// Returns the pending queries of servers listed by the given list engine, oldest first
+func (m *SyncStatusMonitor) GetPendingQueries(listEngine IServerListEngine) []PendingQueryStatus {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var now = time.Now()
+	var pending []PendingQueryStatus
+	for _, queryItem := range m.queries {
+		if queryItem.listEngine != listEngine {
+			continue
+		}
+		pending = append(pending, PendingQueryStatus{
+			Address:  queryItem.address,
+			Engine:   queryItem.engine,
+			Attempts: queryItem.numAttempts,
+			Age:      now.Sub(queryItem.listed),
+		})
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].Age > pending[j].Age
+	})
+	return pending
+}
+
+// Caller must hold the mutex
+func (m *SyncStatusMonitor) getListStats(engine IServerListEngine) *ServerListEngineStats {
+	stats, exists := m.listStats[engine]
+	if !exists { //list engines which never called BeginServerListEngine
+		stats = &ServerListEngineStats{Started: time.Now()}
+		m.listStats[engine] = stats
+	}
+	return stats
+}
+
+// Caller must hold the mutex
+func (m *SyncStatusMonitor) checkListFinished(stats *ServerListEngineStats) {
+	if stats.Ended && stats.Pending == 0 && stats.Finished.IsZero() {
+		stats.Finished = time.Now()
+	}
+}
+
+func (m *SyncStatusMonitor) getQueryKey(engine IQueryEngine, address netip.AddrPort) queryKey {
+	return queryKey{engine: engine, address: NormalizeAddrPort(address)}
+}
+
 func (m *SyncStatusMonitor) BeginQuery(listEngine IServerListEngine, engine IQueryEngine, address netip.AddrPort) bool {
+	m.mutex.Lock()
 
-	//check for duplicate entry
-	var addr = address.Addr().As4()
-	var ip4Addr = netip.AddrFrom4(addr) //remove ipv6 portion :ffff: (which makes it different)
+	var key = m.getQueryKey(engine, address)
 
-	for element := m.queryList.Front(); element != nil; element = element.Next() {
-		var c *QueryEngineListItem = element.Value.(*QueryEngineListItem)
-		if c.engine == engine && c.address.Addr().Compare(ip4Addr) == 0 && c.address.Port() == address.Port() {
+	if source, isSource := m.groupSources[listEngine]; isSource {
+		listEngine = source.group
+		if !m.addGroupListing(source, key.address) { //already listed by a source this cycle, even if it has since responded
+			m.mutex.Unlock()
 			return false
 		}
 	}
 
-	//no duplicate... proceed
+	//check for duplicate entry
+	if _, exists := m.queries[key]; exists {
+		m.mutex.Unlock()
+		return false
+	}
 
 	var queryItem = &QueryEngineListItem{}
 	queryItem.address = address
 	queryItem.engine = engine
 	queryItem.listEngine = listEngine
-	queryItem.lastPerformed = time.Now()
-	queryItem.numAttempts = 1
+	queryItem.queueIndex = -1
+	queryItem.listed = time.Now()
 
-	m.queryList.PushFront(queryItem)
+	m.queries[key] = queryItem
+
+	var stats = m.getListStats(listEngine)
+	stats.ServersListed++
+	stats.Pending++
+
+	var state = m.getQueryEngineState(engine)
+	state.waiting.push(queryItem)
+
+	var toSend = m.dispatchWaiting(state, time.Now())
+	m.mutex.Unlock()
+
+	m.sendQueries(toSend)
 	return true
 }
 
-func (m *SyncStatusMonitor) CompleteQuery(engine IQueryEngine, address netip.AddrPort) {
-	var addr = address.Addr().As4()
-	var ip4Addr = netip.AddrFrom4(addr) //remove ipv6 portion :ffff: (which makes it different)
+// Time since the pending query to the address was last sent, false if there isn't one
+func (m *SyncStatusMonitor) GetQueryRTT(engine IQueryEngine, address netip.AddrPort) (time.Duration, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 
-	var slEngine IServerListEngine = nil
+	queryItem, exists := m.queries[m.getQueryKey(engine, address)]
+	if !exists || queryItem.lastPerformed.IsZero() {
+		return 0, false
+	}
+	return time.Since(queryItem.lastPerformed), true
+}
 
-	for element := m.queryList.Front(); element != nil; element = element.Next() {
-		var c *QueryEngineListItem = element.Value.(*QueryEngineListItem)
-		if c.engine == engine && c.address.Addr().Compare(ip4Addr) == 0 && c.address.Port() == address.Port() {
-			m.queryList.Remove(element)
-			slEngine = c.listEngine
+// Times the pending query to the address has been sent, including the send in progress. Zero if there isn't one
+func (m *SyncStatusMonitor) GetQueryAttempts(engine IQueryEngine, address netip.AddrPort) int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	queryItem, exists := m.queries[m.getQueryKey(engine, address)]
+	if !exists {
+		return 0
+	}
+	return queryItem.numAttempts
+}
+
+// Records a source listing a server, returns false if another source listed it first. Caller must hold the mutex
+func (m *SyncStatusMonitor) addGroupListing(source groupSource, address netip.AddrPort) bool {
+	var stats = m.getListStats(source.group)
+	var sourceName = stats.Sources[source.index].Name
+
+	listedBy, listed := stats.ListedBy[address]
+	for _, name := range listedBy {
+		if name == sourceName {
+			return false
 		}
 	}
+	stats.ListedBy[address] = append(listedBy, sourceName)
+	stats.Sources[source.index].ServersListed++
+	return !listed
+}
+
+func (m *SyncStatusMonitor) CompleteQuery(engine IQueryEngine, address netip.AddrPort) {
+	m.mutex.Lock()
 
-	if slEngine != nil {
-		if !m.engineHasPendingQueries(slEngine) {
-			m.EndServerListEngine(slEngine)
+	var key = m.getQueryKey(engine, address)
+	queryItem, exists := m.queries[key]
+	if !exists {
+		m.mutex.Unlock()
+		return
+	}
+	m.removeQuery(key, queryItem)
+	m.getListStats(queryItem.listEngine).Responses++
+	if m.observer != nil {
+		m.observer.OnQueryResponse(queryItem.listEngine, engine, time.Since(queryItem.lastPerformed))
+	}
+
+	var toSend = m.dispatchWaiting(m.getQueryEngineState(engine), time.Now())
+	m.mutex.Unlock()
+
+	m.sendQueries(toSend)
+}
+
+// Caller must hold the mutex
+func (m *SyncStatusMonitor) removeQuery(key queryKey, queryItem *QueryEngineListItem) {
+	delete(m.queries, key)
+
+	var stats = m.getListStats(queryItem.listEngine)
+	stats.Pending--
+	m.checkListFinished(stats)
+
+	var state = m.getQueryEngineState(queryItem.engine)
+	if queryItem.waitingElement != nil {
+		state.waiting.remove(queryItem)
+	}
+	if queryItem.queueIndex >= 0 { //was sent, release its slot
+		heap.Remove(&m.retryQueue, queryItem.queueIndex)
+		state.outstanding--
+		state.waiting.release(queryItem.address)
+	}
+}
+
+/*
+Moves as many waiting queries into the retry queue as the rate limit allows and returns them to be sent.
+Queries to a /24 which is at its limit stay in its own queue, so they don't hold up the rest.
+Caller must hold the mutex
+*/
+func (m *SyncStatusMonitor) dispatchWaiting(state *queryEngineState, now time.Time) []QueryEngineListItem {
+	var toSend []QueryEngineListItem
+	var limit = state.limiter.limit
+
+	for state.waiting.hasReady() {
+		if limit.MaxOutstanding > 0 && state.outstanding >= limit.MaxOutstanding {
+			break
+		}
+		if !state.limiter.takeTokens(now, state.packetsPerQuery) {
+			break
 		}
+
+		var queryItem = state.waiting.pop()
+		state.outstanding++
+
+		queryItem.lastPerformed = now
+		queryItem.numAttempts = 1
+		queryItem.deadline = now.Add(state.retryPolicy.Timeout(queryItem.numAttempts))
+		heap.Push(&m.retryQueue, queryItem)
+		m.getListStats(queryItem.listEngine).QueriesSent++
+		if m.observer != nil {
+			m.observer.OnQuerySent(queryItem.listEngine, queryItem.engine, false)
+		}
+
+		toSend = append(toSend, *queryItem)
+	}
+	return toSend
+}
+
+// Sending may block, so never do it while holding the lock
+func (m *SyncStatusMonitor) sendQueries(queries []QueryEngineListItem) {
+	for _, c := range queries {
+		c.engine.Query(c.address)
 	}
 }
 
 func (m *SyncStatusMonitor) AllEnginesComplete() bool {
-	return m.serverEngineList.Len() == 0 && m.queryList.Len() == 0
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return len(m.serverEngines) == 0 && len(m.queries) == 0
 }
 
 func (m *SyncStatusMonitor) Think() {
-	var toComplete []*QueryEngineListItem
+	var toSend []QueryEngineListItem
+	var timedOut []QueryEngineListItem
+
+	m.mutex.Lock()
 	now := time.Now()
-	for element := m.queryList.Front(); element != nil; element = element.Next() {
-		var c *QueryEngineListItem = element.Value.(*QueryEngineListItem)
-		var diff = now.Sub(c.lastPerformed)
+	for {
+		var c = m.retryQueue.Peek()
+		if c == nil || c.deadline.After(now) {
+			break
+		}
+
+		var state = m.getQueryEngineState(c.engine)
+		if c.numAttempts >= state.retryPolicy.Attempts {
+			m.removeQuery(m.getQueryKey(c.engine, c.address), c)
+			m.getListStats(c.listEngine).Abandoned++
+			if m.observer != nil {
+				m.observer.OnQueryAbandoned(c.listEngine, c.engine)
+			}
+			GetLogger(c.engine).Debug("Abandoned query", "server", c.address.String(), "attempts", c.numAttempts)
+			timedOut = append(timedOut, *c)
+			continue
+		}
 
-		var max = time.Duration(RETRY_SECONDS) * time.Second
-		if c.numAttempts > MAX_ATTEMPTS {
-			toComplete = append(toComplete, c)
-		} else if diff > max {
-			c.lastPerformed = time.Now()
-			c.numAttempts = c.numAttempts + 1
-			c.engine.Query(c.address)
+		if !state.limiter.takeTokens(now, state.packetsPerQuery) { //try again next think, without using up an attempt
+			c.deadline = now.Add(THINK_INTERVAL)
+			heap.Fix(&m.retryQueue, c.queueIndex)
+			continue
 		}
+
+		c.lastPerformed = now
+		c.numAttempts = c.numAttempts + 1
+		c.deadline = now.Add(state.retryPolicy.Timeout(c.numAttempts))
+		heap.Fix(&m.retryQueue, c.queueIndex)
+		var stats = m.getListStats(c.listEngine)
+		stats.QueriesSent++
+		stats.Retries++
+		if m.observer != nil {
+			m.observer.OnQuerySent(c.listEngine, c.engine, true)
+		}
+		toSend = append(toSend, *c)
+	}
+
+	for _, state := range m.queryEngines {
+		toSend = append(toSend, m.dispatchWaiting(state, now)...)
 	}
-	for _, c := range toComplete {
-		m.CompleteQuery(c.engine, c.address)
-		log.Printf("abandon query: %s\n", c.address.String())
+	var outputs = make([]IQueryOutputLifecycle, len(timedOut))
+	for i, query := range timedOut {
+		outputs[i] = m.outputs[query.listEngine].output
+	}
+	m.mutex.Unlock()
+
+	for i, query := range timedOut {
+		if outputs[i] == nil {
+			continue
+		}
+		var address = query.address
+		if mapper, ok := query.engine.(IOutputAddressMapper); ok {
+			address = mapper.GetOutputAddress(address)
+		}
+		outputs[i].OnServerTimeout(address)
 	}
+	m.sendQueries(toSend)
 }
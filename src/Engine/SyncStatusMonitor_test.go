@@ -0,0 +1,296 @@
+package Engine
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeQueryEngine struct {
+	mutex   sync.Mutex
+	queries []netip.AddrPort
+}
+
+func (e *fakeQueryEngine) SetMonitor(monitor *SyncStatusMonitor) {
+}
+
+func (e *fakeQueryEngine) SetParams(params interface{}) {
+}
+
+func (e *fakeQueryEngine) SetOutputHandler(handler IQueryOutputHandler) {
+}
+
+func (e *fakeQueryEngine) Query(address netip.AddrPort) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.queries = append(e.queries, address)
+}
+
+func (e *fakeQueryEngine) Shutdown() {
+}
+
+// Returns the queries sent since the last call
+func (e *fakeQueryEngine) takeQueries() []netip.AddrPort {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	var queries = e.queries
+	e.queries = nil
+	return queries
+}
+
+type fakeServerListEngine struct{}
+
+func (e *fakeServerListEngine) SetQueryEngine(engine IQueryEngine) {
+}
+
+func (e *fakeServerListEngine) SetParams(params interface{}) {
+}
+
+func (e *fakeServerListEngine) Invoke(monitor *SyncStatusMonitor, parentCtx context.Context) {
+}
+
+func (e *fakeServerListEngine) Shutdown() {
+}
+
+type fakeLifecycle struct {
+	OutputLifecycleBase
+	timedOut []netip.AddrPort
+}
+
+func (l *fakeLifecycle) OnServerTimeout(address netip.AddrPort) {
+	l.timedOut = append(l.timedOut, address)
+}
+
+func newTestMonitor() (*SyncStatusMonitor, *fakeServerListEngine, *fakeQueryEngine) {
+	var monitor = &SyncStatusMonitor{}
+	monitor.Init()
+	var listEngine = &fakeServerListEngine{}
+	monitor.BeginServerListEngine(listEngine)
+	return monitor, listEngine, &fakeQueryEngine{}
+}
+
+func getTestAddress(i int) netip.AddrPort {
+	return netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, byte(i >> 16), byte(i >> 8), byte(i)}), 27900)
+}
+
+func TestBeginQueryDuplicate(t *testing.T) {
+	monitor, listEngine, queryEngine := newTestMonitor()
+	var address = netip.MustParseAddrPort("10.0.0.1:27900")
+	var mapped = netip.AddrPortFrom(netip.AddrFrom16(address.Addr().As16()), address.Port())
+
+	if !monitor.BeginQuery(listEngine, queryEngine, address) {
+		t.Fatal("first BeginQuery returned false")
+	}
+	if monitor.BeginQuery(listEngine, queryEngine, address) {
+		t.Error("duplicate BeginQuery returned true")
+	}
+	if monitor.BeginQuery(listEngine, queryEngine, mapped) {
+		t.Error("BeginQuery of the IPv4-mapped address returned true")
+	}
+	if !monitor.BeginQuery(listEngine, &fakeQueryEngine{}, address) {
+		t.Error("BeginQuery with another query engine returned false")
+	}
+	if sent := queryEngine.takeQueries(); len(sent) != 1 {
+		t.Errorf("sent %d queries, want 1", len(sent))
+	}
+
+	monitor.CompleteQuery(queryEngine, mapped)
+	if !monitor.BeginQuery(listEngine, queryEngine, address) {
+		t.Error("BeginQuery after CompleteQuery returned false")
+	}
+
+	stats, _ := monitor.GetServerListEngineStats(listEngine)
+	if stats.ServersListed != 3 || stats.Responses != 1 || stats.Pending != 2 {
+		t.Errorf("got listed %d, responses %d, pending %d, want 3, 1, 2", stats.ServersListed, stats.Responses, stats.Pending)
+	}
+}
+
+func TestRetryThenAbandon(t *testing.T) {
+	monitor, listEngine, queryEngine := newTestMonitor()
+	var lifecycle = &fakeLifecycle{}
+	monitor.SetOutput(listEngine, "test", lifecycle)
+	monitor.SetRetryPolicy(queryEngine, RetryPolicy{Attempts: 2, InitialTimeoutMs: 1})
+
+	var address = netip.MustParseAddrPort("10.0.0.1:27900")
+	monitor.BeginQuery(listEngine, queryEngine, address)
+	monitor.EndServerListEngine(listEngine, nil)
+
+	time.Sleep(5 * time.Millisecond)
+	monitor.Think()
+	if sent := queryEngine.takeQueries(); len(sent) != 2 {
+		t.Fatalf("sent %d queries after the first timeout, want 2", len(sent))
+	}
+	if attempts := monitor.GetQueryAttempts(queryEngine, address); attempts != 2 {
+		t.Errorf("got %d attempts, want 2", attempts)
+	}
+	if monitor.AllEnginesComplete() {
+		t.Fatal("complete before the query was abandoned")
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	monitor.Think()
+	if sent := queryEngine.takeQueries(); len(sent) != 0 {
+		t.Errorf("sent %d queries after the last attempt, want 0", len(sent))
+	}
+	if !monitor.AllEnginesComplete() {
+		t.Error("not complete after the query was abandoned")
+	}
+	if attempts := monitor.GetQueryAttempts(queryEngine, address); attempts != 0 {
+		t.Errorf("got %d attempts after the query was abandoned, want 0", attempts)
+	}
+	if len(lifecycle.timedOut) != 1 || lifecycle.timedOut[0] != address {
+		t.Errorf("got timeouts %v, want [%v]", lifecycle.timedOut, address)
+	}
+
+	stats, _ := monitor.GetServerListEngineStats(listEngine)
+	if stats.QueriesSent != 2 || stats.Retries != 1 || stats.Abandoned != 1 || stats.Finished.IsZero() {
+		t.Errorf("got sent %d, retries %d, abandoned %d, finished %v", stats.QueriesSent, stats.Retries, stats.Abandoned, stats.Finished)
+	}
+
+	monitor.CompleteQuery(queryEngine, address) //a late response is ignored
+	stats, _ = monitor.GetServerListEngineStats(listEngine)
+	if stats.Responses != 0 || stats.Pending != 0 {
+		t.Errorf("got responses %d, pending %d after a late response, want 0, 0", stats.Responses, stats.Pending)
+	}
+}
+
+type fakeGamePortQueryEngine struct {
+	fakeQueryEngine
+}
+
+func (e *fakeGamePortQueryEngine) GetOutputAddress(address netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(address.Addr(), address.Port()-1)
+}
+
+func TestTimeoutOutputAddress(t *testing.T) {
+	monitor, listEngine, _ := newTestMonitor()
+	var queryEngine = &fakeGamePortQueryEngine{}
+	var lifecycle = &fakeLifecycle{}
+	monitor.SetOutput(listEngine, "test", lifecycle)
+	monitor.SetRetryPolicy(queryEngine, RetryPolicy{Attempts: 1, InitialTimeoutMs: 1})
+
+	monitor.BeginQuery(listEngine, queryEngine, netip.MustParseAddrPort("10.0.0.1:7778"))
+	time.Sleep(5 * time.Millisecond)
+	monitor.Think()
+
+	var want = netip.MustParseAddrPort("10.0.0.1:7777")
+	if len(lifecycle.timedOut) != 1 || lifecycle.timedOut[0] != want {
+		t.Errorf("got timeouts %v, want [%v]", lifecycle.timedOut, want)
+	}
+}
+
+func TestRateLimitRelease(t *testing.T) {
+	monitor, listEngine, queryEngine := newTestMonitor()
+	monitor.SetRetryPolicy(queryEngine, RetryPolicy{Attempts: 1, InitialTimeoutMs: 1})
+	monitor.SetRateLimit(queryEngine, RateLimit{MaxOutstanding: 2, MaxOutstandingPer24: 1})
+
+	var subnetA = []netip.AddrPort{
+		netip.MustParseAddrPort("10.0.0.1:27900"),
+		netip.MustParseAddrPort("10.0.0.2:27900"),
+		netip.MustParseAddrPort("10.0.0.3:27900"),
+	}
+	var subnetB = netip.MustParseAddrPort("10.0.1.1:27900")
+	var subnetC = netip.MustParseAddrPort("10.0.2.1:27900")
+	for _, address := range append(subnetA, subnetB, subnetC) {
+		monitor.BeginQuery(listEngine, queryEngine, address)
+	}
+
+	var expectSent = func(step string, want ...netip.AddrPort) {
+		t.Helper()
+		var sent = queryEngine.takeQueries()
+		if len(sent) != len(want) {
+			t.Fatalf("%s: sent %v, want %v", step, sent, want)
+		}
+		for i := range want {
+			if sent[i] != want[i] {
+				t.Fatalf("%s: sent %v, want %v", step, sent, want)
+			}
+		}
+	}
+	expectSent("listed", subnetA[0], subnetB)
+
+	monitor.CompleteQuery(queryEngine, subnetB) //frees a slot, subnet A is still at its limit
+	expectSent("response from B", subnetC)
+
+	monitor.CompleteQuery(queryEngine, subnetA[0])
+	expectSent("response from A", subnetA[1])
+
+	time.Sleep(5 * time.Millisecond)
+	monitor.Think() //abandons both, releasing their slots
+	expectSent("abandoned", subnetA[2])
+
+	stats, _ := monitor.GetServerListEngineStats(listEngine)
+	if stats.QueriesSent != 5 || stats.Abandoned != 2 || stats.Pending != 1 {
+		t.Errorf("got sent %d, abandoned %d, pending %d, want 5, 2, 1", stats.QueriesSent, stats.Abandoned, stats.Pending)
+	}
+}
+
+type fakeMultiPacketQueryEngine struct {
+	fakeQueryEngine
+}
+
+func (e *fakeMultiPacketQueryEngine) PacketsPerQuery() int {
+	return 3
+}
+
+func TestRateLimitPacketsPerQuery(t *testing.T) {
+	monitor, listEngine, _ := newTestMonitor()
+	var queryEngine = &fakeMultiPacketQueryEngine{}
+	//a bucket of 40*THINK_INTERVAL+1 = 11 packets, each query takes 3 once a token is left
+	monitor.SetRateLimit(queryEngine, RateLimit{PacketsPerSecond: 40})
+
+	for i := 0; i < 20; i++ {
+		monitor.BeginQuery(listEngine, queryEngine, getTestAddress(i))
+	}
+	if sent := queryEngine.takeQueries(); len(sent) != 4 {
+		t.Errorf("sent %d queries, want 4", len(sent))
+	}
+}
+
+const BENCHMARK_SERVERS = 100000
+
+func BenchmarkBeginCompleteQuery(b *testing.B) {
+	var queryEngine = &fakeQueryEngine{}
+	for i := 0; i < b.N; i++ {
+		var monitor = &SyncStatusMonitor{}
+		monitor.Init()
+		var listEngine = &fakeServerListEngine{}
+		monitor.BeginServerListEngine(listEngine)
+
+		for j := 0; j < BENCHMARK_SERVERS; j++ {
+			monitor.BeginQuery(listEngine, queryEngine, getTestAddress(j))
+		}
+		monitor.Think()
+		for j := 0; j < BENCHMARK_SERVERS; j++ {
+			monitor.CompleteQuery(queryEngine, getTestAddress(j))
+		}
+		monitor.EndServerListEngine(listEngine, nil)
+		if !monitor.AllEnginesComplete() {
+			b.Fatal("queries left pending")
+		}
+		queryEngine.takeQueries()
+	}
+}
+
+// Most servers wait behind a few /24s at their limit, as when a master server lists many servers per host
+func BenchmarkBeginQueryPer24Limit(b *testing.B) {
+	var queryEngine = &fakeQueryEngine{}
+	for i := 0; i < b.N; i++ {
+		var monitor = &SyncStatusMonitor{}
+		monitor.Init()
+		monitor.SetRateLimit(queryEngine, RateLimit{MaxOutstandingPer24: 4})
+		var listEngine = &fakeServerListEngine{}
+		monitor.BeginServerListEngine(listEngine)
+
+		for j := 0; j < BENCHMARK_SERVERS; j++ {
+			var address = netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, byte(j % 20), 1}), uint16(1024+j/20))
+			monitor.BeginQuery(listEngine, queryEngine, address)
+			if j%4 == 0 {
+				monitor.Think()
+			}
+		}
+		queryEngine.takeQueries()
+	}
+}
@@ -0,0 +1,288 @@
+package Engine
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	UDP_READ_BUFFER_SIZE int           = 65536           //the largest UDP payload, full query responses with player lists often exceed one MTU
+	SHARED_ROUTE_TTL     time.Duration = 2 * time.Minute //how long a sent query is used to route responses on a shared socket
+)
+
+// Embedded by the params of query engines which send from a UDP socket
+type UDPSocketParams struct {
+	SourcePort uint16 `json:"source_port" validate:"bindport"`
+	SharedPort bool   `json:"shared_port"` //share source_port with every other query engine which sets shared_port
+}
+
+// Implemented by params which may bind a port other engines also bind, see Config's port checks
+type ISharedPortParams interface {
+	IsSharedPort() bool
+}
+
+func (p UDPSocketParams) IsSharedPort() bool {
+	return p.SharedPort
+}
+
+// Implemented by query engines to receive the packets of their UDPSocket
+type IUDPReceiver interface {
+	// Called from the socket's read goroutine, packet is only valid until it returns
+	HandlePacket(source *net.UDPAddr, packet []byte)
+
+	// Whether packet looks like a response of the engine's protocol, used to route responses on a shared socket
+	MatchesPacket(packet []byte) bool
+}
+
+/*
+A query engine's UDP socket, either bound just for it or shared with other query engines on the same port.
+A shared socket routes each response to the engine with a query pending to its source address, or when
+several or none have one, to the first whose protocol signature matches.
+*/
+type UDPSocket struct {
+	receiver   IUDPReceiver
+	connection *net.UDPConn     //nil when shared
+	shared     *sharedUDPSocket //nil when not shared
+	closed     atomic.Bool
+}
+
+type pendingSend struct {
+	socket *UDPSocket
+	sent   time.Time
+}
+
+type sharedUDPSocket struct {
+	port       uint16
+	connection *net.UDPConn
+
+	mutex     sync.Mutex
+	sockets   []*UDPSocket
+	pending   map[netip.AddrPort][]pendingSend
+	lastPrune time.Time
+}
+
+var sharedSockets = make(map[uint16]*sharedUDPSocket)
+var sharedSocketsMutex sync.Mutex
+
+func OpenUDPSocket(params UDPSocketParams, receiver IUDPReceiver) (*UDPSocket, error) {
+	var socket = &UDPSocket{receiver: receiver}
+
+	if params.SharedPort {
+		shared, err := joinSharedSocket(params.SourcePort, socket)
+		if err != nil {
+			return nil, err
+		}
+		socket.shared = shared
+		return socket, nil
+	}
+
+	connection, err := listenUDP(params.SourcePort)
+	if err != nil {
+		return nil, err
+	}
+	socket.connection = connection
+	var getLogger = func() *slog.Logger { return GetLogger(receiver) } //the engine's logger is set after it is configured
+	go readPackets(connection, getLogger, func(source *net.UDPAddr, packet []byte) {
+		receiver.HandlePacket(source, packet)
+	})
+	return socket, nil
+}
+
+func listenUDP(port uint16) (*net.UDPConn, error) {
+	addr := net.UDPAddr{
+		Port: int(port), //no IP, so the socket is dual-stack
+	}
+	return net.ListenUDP("udp", &addr)
+}
+
+// Reads until the connection is closed. A packet which makes its handler panic is logged and dropped
+func readPackets(connection *net.UDPConn, getLogger func() *slog.Logger, handle func(source *net.UDPAddr, packet []byte)) {
+	defer connection.Close()
+
+	var handleSafely = func(source *net.UDPAddr, packet []byte) {
+		defer func() {
+			if err := recover(); err != nil {
+				getLogger().Error("Failed to handle packet", "server", source.String(), "error", err)
+			}
+		}()
+		handle(source, packet)
+	}
+
+	buf := make([]byte, UDP_READ_BUFFER_SIZE)
+	for {
+		len, addr, err := connection.ReadFromUDP(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				getLogger().Error("Recvfrom failed", "error", err)
+			}
+			return
+		}
+		handleSafely(addr, buf[:len])
+	}
+}
+
+func (s *UDPSocket) WriteTo(packet []byte, destination netip.AddrPort) error {
+	if s.closed.Load() {
+		return net.ErrClosed
+	}
+	if s.shared == nil {
+		_, err := s.connection.WriteToUDPAddrPort(packet, destination)
+		return err
+	}
+	s.shared.addPending(s, destination)
+	_, err := s.shared.connection.WriteToUDPAddrPort(packet, destination)
+	return err
+}
+
+// A shared socket stays open until every engine using it has closed
+func (s *UDPSocket) Close() {
+	if s.closed.Swap(true) {
+		return
+	}
+	if s.shared == nil {
+		s.connection.Close()
+		return
+	}
+	s.shared.remove(s)
+}
+
+// Adds socket to the shared socket on port, binding it if this is the first engine to use it
+func joinSharedSocket(port uint16, socket *UDPSocket) (*sharedUDPSocket, error) {
+	sharedSocketsMutex.Lock()
+	defer sharedSocketsMutex.Unlock()
+
+	if shared, exists := sharedSockets[port]; exists {
+		shared.add(socket)
+		return shared, nil
+	}
+
+	connection, err := listenUDP(port)
+	if err != nil {
+		return nil, err
+	}
+	var shared = &sharedUDPSocket{port: port, connection: connection, pending: make(map[netip.AddrPort][]pendingSend)}
+	sharedSockets[port] = shared
+	shared.add(socket)
+
+	var logger = slog.With("shared_port", port)
+	go readPackets(connection, func() *slog.Logger { return logger }, shared.route)
+	return shared, nil
+}
+
+func (s *sharedUDPSocket) add(socket *UDPSocket) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.sockets = append(s.sockets, socket)
+}
+
+func (s *sharedUDPSocket) remove(socket *UDPSocket) {
+	sharedSocketsMutex.Lock()
+	defer sharedSocketsMutex.Unlock()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i := range s.sockets {
+		if s.sockets[i] == socket {
+			s.sockets = append(s.sockets[:i], s.sockets[i+1:]...)
+			break
+		}
+	}
+	if len(s.sockets) == 0 {
+		delete(sharedSockets, s.port)
+		s.connection.Close()
+	}
+}
+
+func (s *sharedUDPSocket) addPending(socket *UDPSocket, destination netip.AddrPort) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var now = time.Now()
+	if now.Sub(s.lastPrune) > SHARED_ROUTE_TTL {
+		s.prune(now)
+	}
+
+	var key = NormalizeAddrPort(destination)
+	var sends = s.pending[key]
+	for i := range sends {
+		if sends[i].socket == socket { //a retry
+			sends[i].sent = now
+			return
+		}
+	}
+	s.pending[key] = append(sends, pendingSend{socket, now})
+}
+
+// Caller must hold the mutex
+func (s *sharedUDPSocket) prune(now time.Time) {
+	s.lastPrune = now
+	for key, sends := range s.pending {
+		var kept []pendingSend
+		for _, send := range sends {
+			if now.Sub(send.sent) <= SHARED_ROUTE_TTL {
+				kept = append(kept, send)
+			}
+		}
+		if len(kept) == 0 {
+			delete(s.pending, key)
+		} else {
+			s.pending[key] = kept
+		}
+	}
+}
+
+// Picks the socket a packet is for, caller must hold the mutex
+func (s *sharedUDPSocket) getDestination(source netip.AddrPort, packet []byte) *UDPSocket {
+	var key = NormalizeAddrPort(source)
+	var sends = s.pending[key]
+
+	var candidates []*UDPSocket
+	for _, send := range sends {
+		if !send.socket.closed.Load() {
+			candidates = append(candidates, send.socket)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = s.sockets
+	} else if len(candidates) == 1 {
+		return candidates[0]
+	}
+
+	for _, candidate := range candidates {
+		if candidate.receiver.MatchesPacket(packet) {
+			return candidate
+		}
+	}
+	return nil
+}
+
+func (s *sharedUDPSocket) route(source *net.UDPAddr, packet []byte) {
+	s.mutex.Lock()
+	var socket = s.getDestination(source.AddrPort(), packet)
+	if socket != nil {
+		var key = NormalizeAddrPort(source.AddrPort())
+		var sends = s.pending[key]
+		for i := range sends {
+			if sends[i].socket == socket {
+				s.pending[key] = append(sends[:i], sends[i+1:]...)
+				break
+			}
+		}
+		if len(s.pending[key]) == 0 {
+			delete(s.pending, key)
+		}
+	}
+	s.mutex.Unlock()
+
+	if socket == nil {
+		slog.Debug("Dropped packet, no query engine on the shared port matches it", "shared_port", s.port, "server", source.String(), "length", len(packet))
+		return
+	}
+	socket.receiver.HandlePacket(source, packet)
+}
@@ -0,0 +1,184 @@
+package Engines
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os-serverlist-sync/Engine"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type FileOutputHandlerParams struct {
+	Directory string `json:"directory" validate:"required"`
+	Name      string `json:"name"` //file name prefix, the gamename or "servers" when not set
+	Gamename  string `json:"gamename"`
+	Snapshot  bool   `json:"snapshot"` //also write <name>.json with the last response of each server in the run
+}
+
+/*
+Archives server responses, one NDJSON file per sync cycle under a directory for each date (UTC):
+
+	<directory>/2006-01-02/<name>-150405.000.ndjson
+
+Files are written under a temporary name and renamed into place once complete, as is the snapshot,
+so readers never see a partial file. Only called from the pipeline's Engine.OutputFanOut goroutine.
+*/
+type FileOutputHandler struct {
+	Engine.LogContext
+
+	params *FileOutputHandlerParams
+
+	file      *os.File //the current run's temporary file, nil until its first response
+	writer    *bufio.Writer
+	finalPath string
+	snapshot  map[string]serverRecord
+
+	outputWrites atomic.Uint64
+	outputErrors atomic.Uint64
+}
+
+func (oh *FileOutputHandler) SetParams(params interface{}) {
+	oh.params = params.(*FileOutputHandlerParams)
+}
+
+func (oh *FileOutputHandler) getName() string {
+	if len(oh.params.Name) > 0 {
+		return oh.params.Name
+	}
+	if len(oh.params.Gamename) > 0 {
+		return oh.params.Gamename
+	}
+	return "servers"
+}
+
+func (oh *FileOutputHandler) beginRun(now time.Time) error {
+	var directory = filepath.Join(oh.params.Directory, now.Format("2006-01-02"))
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return err
+	}
+
+	var fileName = fmt.Sprintf("%s-%s.ndjson", oh.getName(), now.Format("150405.000"))
+	file, err := os.CreateTemp(directory, "."+fileName+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	oh.file = file
+	oh.writer = bufio.NewWriter(file)
+	oh.finalPath = filepath.Join(directory, fileName)
+	oh.snapshot = make(map[string]serverRecord)
+	return nil
+}
+
+func (oh *FileOutputHandler) OnServerInfoResponse(sourceAddress net.Addr, serverProperties map[string]string) {
+	oh.OnServerInfo(sourceAddress, &Engine.ServerInfo{Keys: serverProperties})
+}
+
+func (oh *FileOutputHandler) OnServerInfo(sourceAddress net.Addr, info *Engine.ServerInfo) {
+	var now = time.Now().UTC()
+	var record = newServerRecord(now, oh.params.Gamename, sourceAddress, info)
+	var address = record.Address
+
+	if oh.file == nil {
+		if err := oh.beginRun(now); err != nil {
+			oh.Logger().Error("Failed to create output file", "directory", oh.params.Directory, "error", err)
+			oh.outputErrors.Add(1)
+			return
+		}
+	}
+
+	data, err := json.Marshal(record)
+	if err == nil {
+		_, err = oh.writer.Write(append(data, '\n'))
+	}
+	if err != nil {
+		oh.Logger().Error("Failed to write server", "server", address, "path", oh.file.Name(), "error", err)
+		oh.outputErrors.Add(1)
+		return
+	}
+
+	oh.snapshot[address] = record
+	oh.outputWrites.Add(1)
+}
+
+// Completes the run: its NDJSON file is moved into place, and the snapshot written when enabled
+func (oh *FileOutputHandler) Flush() error {
+	if oh.file == nil {
+		return nil
+	}
+	var file = oh.file
+	oh.file = nil
+
+	var err = oh.writer.Flush()
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), oh.finalPath)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return fmt.Errorf("failed to write %s: %w", oh.finalPath, err)
+	}
+
+	if oh.params.Snapshot {
+		var snapshotPath = filepath.Join(oh.params.Directory, oh.getName()+".json")
+		if err := writeFileAtomic(snapshotPath, oh.snapshot); err != nil {
+			return fmt.Errorf("failed to write snapshot %s: %w", snapshotPath, err)
+		}
+	}
+	return nil
+}
+
+// Writes value as indented JSON to a temporary file next to path, then renames it onto path
+func writeFileAtomic(path string, value interface{}) error {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+func (oh *FileOutputHandler) GetOutputStats() Engine.OutputStats {
+	return Engine.OutputStats{
+		Writes: oh.outputWrites.Load(),
+		Errors: oh.outputErrors.Load(),
+	}
+}
+
+func (oh *FileOutputHandler) GetGamename() string {
+	return oh.params.Gamename
+}
+
+func (p *FileOutputHandlerParams) ValidateParams() []Engine.ParamError {
+	if strings.ContainsAny(p.Name, `/\`) {
+		return []Engine.ParamError{{Field: "name", Message: "must be a file name, not a path"}}
+	}
+	return nil
+}
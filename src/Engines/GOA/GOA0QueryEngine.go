@@ -1,43 +1,40 @@
 package GOA
 
 import (
-	"log"
+	"context"
 	"net"
 	"net/netip"
-	"os"
 	"os-serverlist-sync/Engine"
+	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
 )
 
 type QueryEngineParams struct {
-	SourcePort uint16 `json:"source_port"`
+	Engine.UDPSocketParams
 }
 
 type QueryEngine struct {
+	Engine.LogContext
+
 	params        *QueryEngineParams
-	connection    *net.UDPConn
+	socket        *Engine.UDPSocket
 	outputHandler Engine.IQueryOutputHandler
-	monitor       Engine.SyncStatusMonitor
+	monitor       atomic.Pointer[Engine.SyncStatusMonitor] //swapped per sync cycle while the socket is receiving
+	bindError     error
 }
 
 func (qe *QueryEngine) SetParams(params interface{}) {
 	qe.params = params.(*QueryEngineParams)
 
-	addr := net.UDPAddr{
-		Port: int(qe.params.SourcePort),
-		IP:   net.ParseIP("0.0.0.0"),
-	}
-	ser, err := net.ListenUDP("udp", &addr)
+	socket, err := Engine.OpenUDPSocket(qe.params.UDPSocketParams, qe)
 	if err != nil {
-		log.Println("GOA QueryEngine bind failed:", err.Error())
-		os.Exit(1)
+		qe.Logger().Error("Query engine bind failed", "source_port", qe.params.SourcePort, "error", err)
+		qe.bindError = err //not fatal, the pipeline reports not ready and its queries are dropped
+		return
 	}
-
-	qe.connection = ser
-
-	go func() {
-		qe.listen()
-	}()
+	qe.socket = socket
 }
 
 func (qe *QueryEngine) SetOutputHandler(handler Engine.IQueryOutputHandler) {
@@ -45,53 +42,136 @@ func (qe *QueryEngine) SetOutputHandler(handler Engine.IQueryOutputHandler) {
 }
 
 func (qe *QueryEngine) Query(destination netip.AddrPort) {
-	var addr = net.UDPAddrFromAddrPort(destination)
-	log.Printf("GOA Send query to: %s\n", addr.String())
-	qe.connection.WriteToUDP([]byte("\\status\\"), addr)
+	if qe.socket == nil {
+		return
+	}
+	qe.Logger().Debug("Send query", "server", destination.String())
+	qe.socket.WriteTo([]byte("\\status\\"), destination)
 }
 
-func (qe *QueryEngine) listen() {
-	defer qe.connection.Close()
+// Responses are \key\value pairs
+func (qe *QueryEngine) MatchesPacket(packet []byte) bool {
+	return len(packet) > 0 && packet[0] == '\\'
+}
+
+func (qe *QueryEngine) HandlePacket(addr *net.UDPAddr, packet []byte) {
+	if qe.outputHandler == nil {
+		return
+	}
+
+	var info = parseStatus(string(packet))
+	var monitor = qe.monitor.Load()
+	if monitor != nil {
+		info.RTT, _ = monitor.GetQueryRTT(qe, addr.AddrPort())
+	}
 
-	buf := make([]byte, 1492)
-	for {
-		len, addr, err := qe.connection.ReadFrom(buf)
-		if err != nil {
-			log.Println("GOA Recvfrom failed:", err.Error())
-			break
+	Engine.WriteServerInfo(qe.outputHandler, addr, info)
+	if monitor != nil {
+		monitor.CompleteQuery(qe, addr.AddrPort())
+	}
+}
+
+/*
+Reads a \status\ response. Player keys are suffixed with the player's index (\player_0\name\frags_0\10)
+and team keys with t and the team's index (\team_t0\Red\score_t0\5), these are read into Players
+and Teams as well, Keys is unchanged for handlers which only take keys.
+*/
+func parseStatus(response string) *Engine.ServerInfo {
+	var info = &Engine.ServerInfo{Protocol: "goa", Keys: make(map[string]string), Rules: make(map[string]string)}
+	var players = make(map[int]*Engine.PlayerInfo)
+	var teams = make(map[int]*Engine.TeamInfo)
+
+	serverProps := strings.Split(response, "\\")
+
+	var lastKey int
+	for idx, v := range serverProps[1:] {
+		if idx%2 == 0 {
+			lastKey = idx
+			continue
+		}
+		var keyName = serverProps[lastKey+1]
+		if keyName == "final" || keyName == "queryid" { //end of data stream
+			continue
 		}
+		info.Keys[keyName] = v
+		info.Rules[keyName] = v
 
-		var inputStr = string(buf[:len])
-
-		if qe.outputHandler != nil {
-			serverProps := strings.Split(inputStr, "\\")
-			propMap := make(map[string]string)
-
-			var lastKey int
-			for idx, v := range serverProps[1:] {
-				if idx%2 == 0 {
-					lastKey = idx
-				} else {
-					var keyName = serverProps[lastKey+1]
-					if keyName == "final" || keyName == "queryid" { //end of data stream
-						continue
-					}
-
-					propMap[keyName] = v
-				}
-			}
-			if qe.outputHandler != nil {
-				qe.outputHandler.OnServerInfoResponse(addr, propMap)
-			}
-			qe.monitor.CompleteQuery(qe, addr.(*net.UDPAddr).AddrPort())
+		if name, index, isTeam, indexed := splitIndexedKey(keyName); indexed && isTeam {
+			getTeam(teams, index).SetKey(name, v)
+		} else if indexed {
+			getPlayer(players, index).SetKey(name, v)
 		}
 	}
+
+	info.Players = sortByIndex(players)
+	info.Teams = sortByIndex(teams)
+	return info
+}
+
+// Splits player_0 into player_ and 0, and score_t1 into score_t, 1 and true for a team key, the names QR2 uses
+func splitIndexedKey(key string) (name string, index int, isTeam bool, indexed bool) {
+	var separator = strings.LastIndexByte(key, '_')
+	if separator <= 0 {
+		return key, 0, false, false
+	}
+	var suffix = key[separator+1:]
+	if strings.HasPrefix(suffix, "t") {
+		suffix = suffix[1:]
+		isTeam = true
+	}
+	index, err := strconv.Atoi(suffix)
+	if err != nil || index < 0 || suffix[0] == '+' {
+		return key, 0, false, false
+	}
+	return key[:len(key)-len(suffix)], index, isTeam, true
+}
+
+func getPlayer(players map[int]*Engine.PlayerInfo, index int) *Engine.PlayerInfo {
+	if player, exists := players[index]; exists {
+		return player
+	}
+	var player = Engine.NewPlayerInfo()
+	players[index] = player
+	return player
+}
+
+func getTeam(teams map[int]*Engine.TeamInfo, index int) *Engine.TeamInfo {
+	if team, exists := teams[index]; exists {
+		return team
+	}
+	var team = Engine.NewTeamInfo()
+	teams[index] = team
+	return team
+}
+
+// The values in index order, nil when there are none
+func sortByIndex[T any](values map[int]*T) []T {
+	if len(values) == 0 {
+		return nil
+	}
+	var indexes = make([]int, 0, len(values))
+	for index := range values {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	var sorted = make([]T, 0, len(indexes))
+	for _, index := range indexes {
+		sorted = append(sorted, *values[index])
+	}
+	return sorted
 }
 
 func (qe *QueryEngine) Shutdown() {
-	qe.connection.Close()
+	if qe.socket != nil {
+		qe.socket.Close()
+	}
+}
+
+func (qe *QueryEngine) CheckHealth(ctx context.Context) error {
+	return qe.bindError
 }
 
-func (qe *QueryEngine) SetMonitor(monitor Engine.SyncStatusMonitor) {
-	qe.monitor = monitor
+func (qe *QueryEngine) SetMonitor(monitor *Engine.SyncStatusMonitor) {
+	qe.monitor.Store(monitor)
 }
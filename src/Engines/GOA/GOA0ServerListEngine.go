@@ -10,7 +10,6 @@ import (
 	"encoding/binary"
 	"errors"
 	"io"
-	"log"
 	"net"
 	"net/netip"
 	"os-serverlist-sync/Engine"
@@ -20,12 +19,12 @@ import (
 )
 
 type ServerListEngineParams struct {
-	ServerAddress    string `json:"address"`
-	Gamename         string `json:"gamename"`
-	Secretkey        string `json:"secretkey"`
-	QueryGamename    string `json:"query_gamename"`
+	ServerAddress    string `json:"address" validate:"required,hostport"`
+	Gamename         string `json:"gamename" validate:"required"`
+	Secretkey        string `json:"secretkey" validate:"required" secret:"true"`
+	QueryGamename    string `json:"query_gamename" validate:"required"`
 	NoCompressedList bool   `json:"no_compressed_list"`
-	MaxChallengeLen  int    `json:"max_challenge_len"` //certain old master servers (UT) send invalid KV/data and only process up to 6 bytes anyways for the challenge
+	MaxChallengeLen  int    `json:"max_challenge_len" validate:"nonnegative"` //certain old master servers (UT) send invalid KV/data and only process up to 6 bytes anyways for the challenge
 	GameVer          string `json:"gamever"`
 	Location         string `json:"location"`
 	AttachQueryID    bool   `json:"attach_queryid"`
@@ -33,10 +32,12 @@ type ServerListEngineParams struct {
 }
 
 type ServerListEngine struct {
+	Engine.LogContext
+
 	connection  *net.TCPConn
 	queryEngine Engine.IQueryEngine
 	params      *ServerListEngineParams
-	monitor     Engine.SyncStatusMonitor
+	monitor     *Engine.SyncStatusMonitor
 
 	ctx       context.Context
 	ctxCancel context.CancelCauseFunc
@@ -50,7 +51,7 @@ func (se *ServerListEngine) SetParams(params interface{}) {
 	se.params = params.(*ServerListEngineParams)
 }
 
-func (se *ServerListEngine) Invoke(monitor Engine.SyncStatusMonitor, parentCtx context.Context) {
+func (se *ServerListEngine) Invoke(monitor *Engine.SyncStatusMonitor, parentCtx context.Context) {
 
 	ctx, cancel := context.WithCancelCause(parentCtx)
 	se.ctx = ctx
@@ -61,14 +62,14 @@ func (se *ServerListEngine) Invoke(monitor Engine.SyncStatusMonitor, parentCtx c
 	se.queryEngine.SetMonitor(monitor)
 
 	go func() {
-		log.Println("Invoke " + se.params.ServerAddress)
+		se.Logger().Info("Fetching server list", "master", se.params.ServerAddress)
 
 		conn, dialErr := net.DialTimeout("tcp", se.params.ServerAddress, 15*time.Second)
 
 		if dialErr != nil {
-			log.Println("Dial failed:", dialErr.Error())
+			se.Logger().Error("Master server dial failed", "master", se.params.ServerAddress, "error", dialErr)
 			cancel(dialErr)
-			se.monitor.EndServerListEngine(se)
+			se.monitor.EndServerListEngine(se, dialErr)
 			return
 		}
 		se.connection = conn.(*net.TCPConn)
@@ -82,7 +83,7 @@ func (se *ServerListEngine) Invoke(monitor Engine.SyncStatusMonitor, parentCtx c
 	go func() {
 		select {
 		case <-se.ctx.Done():
-			se.monitor.EndServerListEngine(se)
+			se.monitor.EndServerListEngine(se, context.Cause(se.ctx))
 			se.Shutdown()
 			return
 		}
@@ -98,7 +99,7 @@ func (se *ServerListEngine) think() {
 
 	_, err := se.connection.Read(reply)
 	if err != nil {
-		log.Println("Failed to read GOA SB Auth Request:", err.Error())
+		se.Logger().Error("Failed to read auth request", "error", err)
 		se.ctxCancel(err)
 		return
 	}
@@ -110,7 +111,8 @@ func (se *ServerListEngine) think() {
 	var secure_idx int = strings.Index(string(reply), "secure\\")
 
 	if secure_idx == -1 {
-		log.Println("GOA Missing secure property")
+		se.Logger().Error("Auth request is missing the secure property")
+		se.ctxCancel(errors.New("GOA Missing secure property"))
 		return
 	}
 
@@ -153,7 +155,7 @@ func (se *ServerListEngine) think() {
 
 	_, err = se.connection.Write([]byte(authQuery + listQuery))
 	if err != nil {
-		log.Println("Failed to write GOA SB Auth Query:", err.Error())
+		se.Logger().Error("Failed to write auth query", "error", err)
 		se.ctxCancel(err)
 		return
 	}
@@ -181,7 +183,7 @@ func (se *ServerListEngine) ReadUncompressedList() {
 		slLen, slErr := se.connection.Read(serverListResponse)
 
 		if slErr != nil && !errors.Is(slErr, io.EOF) {
-			log.Println("Failed to read GOA SB Server List Response:", slErr.Error())
+			se.Logger().Error("Failed to read server list response", "error", slErr)
 			se.ctxCancel(slErr)
 			break
 		}
@@ -227,12 +229,10 @@ func (se *ServerListEngine) handleIPString(inputStr string) {
 
 	addr, err := netip.ParseAddrPort(inputStr)
 	if err != nil {
-		log.Println("GOA Failed to parse IP String:", err.Error(), "Input: ", inputStr)
+		se.Logger().Warn("Failed to parse server address", "input", inputStr, "error", err)
 		return
 	}
-	if se.monitor.BeginQuery(se, se.queryEngine, addr) {
-		se.queryEngine.Query(addr)
-	}
+	se.monitor.BeginQuery(se, se.queryEngine, addr)
 }
 
 func (se *ServerListEngine) ReadCompressedResponse() {
@@ -243,8 +243,8 @@ func (se *ServerListEngine) ReadCompressedResponse() {
 		slLen, slErr := se.connection.Read(serverListResponse)
 
 		if slErr != nil && !errors.Is(slErr, io.EOF) {
-			log.Println("Failed to read GOA SB Server List Response:", slErr.Error())
-			se.monitor.EndServerListEngine(se)
+			se.Logger().Error("Failed to read server list response", "error", slErr)
+			se.ctxCancel(slErr)
 			break
 		}
 
@@ -260,9 +260,7 @@ func (se *ServerListEngine) ReadCompressedResponse() {
 		serverPort := binary.BigEndian.Uint16(serverListResponse[4:])
 
 		var addr = netip.AddrPortFrom(serverIP, serverPort)
-		if se.monitor.BeginQuery(se, se.queryEngine, addr) {
-			se.queryEngine.Query(addr)
-		}
+		se.monitor.BeginQuery(se, se.queryEngine, addr)
 	}
 }
 
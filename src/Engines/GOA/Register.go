@@ -0,0 +1,13 @@
+package GOA
+
+import "os-serverlist-sync/Engine"
+
+func init() {
+	Engine.RegisterServerListEngine("goa0",
+		func() interface{} { return new(ServerListEngineParams) },
+		func() Engine.IServerListEngine { return &ServerListEngine{} })
+
+	Engine.RegisterQueryEngine("goa0",
+		func() interface{} { return new(QueryEngineParams) },
+		func() Engine.IQueryEngine { return &QueryEngine{} })
+}
@@ -11,14 +11,16 @@ import (
 )
 
 type GameServerListerApiEngineParams struct {
-	Url string
+	Url string `validate:"required,url"`
 }
 
 type GameServerListerApiEngine struct {
+	Engine.LogContext
+
 	queryEngine Engine.IQueryEngine
 	params      *GameServerListerApiEngineParams
 
-	monitor   Engine.SyncStatusMonitor
+	monitor   *Engine.SyncStatusMonitor
 	ctx       context.Context
 	ctxCancel context.CancelCauseFunc
 }
@@ -36,7 +38,7 @@ type ServerEntry struct {
 	QueryPort int    `json:"queryPort"`
 }
 
-func (se *GameServerListerApiEngine) Invoke(monitor Engine.SyncStatusMonitor, parentCtx context.Context) {
+func (se *GameServerListerApiEngine) Invoke(monitor *Engine.SyncStatusMonitor, parentCtx context.Context) {
 	ctx, cancel := context.WithCancelCause(parentCtx)
 	se.ctx = ctx
 	se.ctxCancel = cancel
@@ -51,7 +53,7 @@ func (se *GameServerListerApiEngine) Invoke(monitor Engine.SyncStatusMonitor, pa
 	go func() {
 		req, err := http.NewRequest("GET", se.params.Url, nil)
 		if err != nil {
-			fmt.Println("Got HTTP error", err)
+			se.Logger().Error("HTTP request failed", "url", se.params.Url, "error", err)
 			se.ctxCancel(err)
 			return
 		}
@@ -60,11 +62,20 @@ func (se *GameServerListerApiEngine) Invoke(monitor Engine.SyncStatusMonitor, pa
 
 		res, err := client.Do(req)
 		if err != nil {
-			fmt.Println("Got HTTP error", err)
+			se.Logger().Error("HTTP request failed", "url", se.params.Url, "error", err)
 			se.ctxCancel(err)
 			return
 		}
 
+		defer res.Body.Close()
+
+		if res.StatusCode != http.StatusOK {
+			var statusErr = fmt.Errorf("unexpected HTTP status: %s", res.Status)
+			se.Logger().Error("HTTP request failed", "url", se.params.Url, "error", statusErr)
+			se.ctxCancel(statusErr)
+			return
+		}
+
 		data, err := io.ReadAll(res.Body)
 		if err != nil {
 			se.ctxCancel(err)
@@ -72,7 +83,11 @@ func (se *GameServerListerApiEngine) Invoke(monitor Engine.SyncStatusMonitor, pa
 		}
 
 		var params []ServerEntry
-		json.Unmarshal(data, &params)
+		if err := json.Unmarshal(data, &params); err != nil {
+			se.Logger().Error("Failed to parse server list", "url", se.params.Url, "error", err)
+			se.ctxCancel(err)
+			return
+		}
 
 		for _, entry := range params {
 			var addrPort netip.AddrPort
@@ -81,9 +96,7 @@ func (se *GameServerListerApiEngine) Invoke(monitor Engine.SyncStatusMonitor, pa
 				continue
 			}
 			addrPort = netip.AddrPortFrom(addr, uint16(entry.QueryPort))
-			if monitor.BeginQuery(se, se.queryEngine, addrPort) {
-				se.queryEngine.Query(addrPort)
-			}
+			monitor.BeginQuery(se, se.queryEngine, addrPort)
 		}
 
 		se.ctxCancel(nil)
@@ -92,7 +105,7 @@ func (se *GameServerListerApiEngine) Invoke(monitor Engine.SyncStatusMonitor, pa
 	go func() {
 		select {
 		case <-se.ctx.Done():
-			se.monitor.EndServerListEngine(se)
+			se.monitor.EndServerListEngine(se, context.Cause(se.ctx))
 			se.Shutdown()
 			return
 		}
@@ -0,0 +1,9 @@
+package GameServerListerApi
+
+import "os-serverlist-sync/Engine"
+
+func init() {
+	Engine.RegisterServerListEngine("gameserverlister_api",
+		func() interface{} { return new(GameServerListerApiEngineParams) },
+		func() Engine.IServerListEngine { return &GameServerListerApiEngine{} })
+}
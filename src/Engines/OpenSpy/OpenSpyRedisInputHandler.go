@@ -2,9 +2,7 @@ package OpenSpy
 
 import (
 	"context"
-	"crypto/tls"
 	"net/netip"
-	"os"
 	"os-serverlist-sync/Engine"
 	"strconv"
 
@@ -12,14 +10,17 @@ import (
 )
 
 type OpenSpyRedisInputHandlerParams struct {
+	RedisParams
 	Gamename string
 }
 
 type OpenSpyRedisInputHandler struct {
+	Engine.LogContext
+
 	queryEngine Engine.IQueryEngine
 	params      *OpenSpyRedisInputHandlerParams
 
-	monitor     Engine.SyncStatusMonitor
+	monitor     *Engine.SyncStatusMonitor
 	redisClient *redis.Client
 
 	ctx       context.Context
@@ -37,45 +38,7 @@ func (oh *OpenSpyRedisInputHandler) SetParams(params interface{}) {
 }
 
 func (oh *OpenSpyRedisInputHandler) SetupRedis() {
-	redisOptions := &redis.Options{
-		Addr: os.Getenv("REDIS_SERVER"),
-	}
-
-	redisUsername := os.Getenv("REDIS_USERNAME")
-	redisPassword := os.Getenv("REDIS_PASSWORD")
-
-	if len(redisUsername) > 0 {
-		redisOptions.Username = redisUsername
-	}
-	if len(redisPassword) > 0 {
-		redisOptions.Password = redisPassword
-	}
-
-	redisUseTLS := os.Getenv("REDIS_USE_TLS")
-
-	if len(redisUseTLS) > 0 {
-		useTLSInt, _ := strconv.Atoi(redisUseTLS)
-
-		if useTLSInt == 1 {
-			tlsConfig := &tls.Config{
-				MinVersion: tls.VersionTLS12,
-				//InsecureSkipVerify: true,
-				//Certificates: []tls.Certificate{cert}
-			}
-
-			redisSkipSSLVerify := os.Getenv("REDIS_INSECURE_TLS")
-			if len(redisSkipSSLVerify) > 0 {
-				useInsecureTLS, _ := strconv.Atoi(redisSkipSSLVerify)
-
-				if useInsecureTLS == 1 {
-					tlsConfig.InsecureSkipVerify = true
-				}
-			}
-			redisOptions.TLSConfig = tlsConfig
-		}
-	}
-
-	redisOptions.DB = 0
+	redisOptions := getRedisOptions(oh.params.RedisParams)
 	rdb := redis.NewClient(redisOptions)
 
 	oh.redisClient = rdb
@@ -99,7 +62,7 @@ func (oh *OpenSpyRedisInputHandler) SetupRedis() {
 	oh.redisClient.Conn().Select(oh.ctx, 0)
 }
 
-func (oh *OpenSpyRedisInputHandler) Invoke(monitor Engine.SyncStatusMonitor, parentCtx context.Context) {
+func (oh *OpenSpyRedisInputHandler) Invoke(monitor *Engine.SyncStatusMonitor, parentCtx context.Context) {
 
 	ctx, cancel := context.WithCancelCause(parentCtx)
 	oh.ctx = ctx
@@ -121,6 +84,8 @@ func (oh *OpenSpyRedisInputHandler) Invoke(monitor Engine.SyncStatusMonitor, par
 		var scanCmd = oh.redisClient.ZScan(oh.ctx, oh.params.Gamename, cursor, "*", 50)
 		keys, cursor, err = scanCmd.Result()
 		if err != nil {
+			oh.Logger().Error("Failed to scan servers", "error", err)
+			oh.ctxCancel(err)
 			break
 		}
 
@@ -155,17 +120,13 @@ func (oh *OpenSpyRedisInputHandler) Invoke(monitor Engine.SyncStatusMonitor, par
 				wanport = wanport + 1
 			}
 
-			wanport_str = strconv.Itoa(wanport)
-
-			var addrPort netip.AddrPort
-			addrPort, addrErr := netip.ParseAddrPort(wanip + ":" + string(wanport_str))
+			addr, addrErr := netip.ParseAddr(wanip) //may be IPv4 or IPv6
 			if addrErr != nil {
 				continue
 			}
+			var addrPort = netip.AddrPortFrom(addr, uint16(wanport))
 
-			if monitor.BeginQuery(oh, oh.queryEngine, addrPort) {
-				oh.queryEngine.Query(addrPort)
-			}
+			monitor.BeginQuery(oh, oh.queryEngine, addrPort)
 		}
 		if cursor == 0 {
 			break
@@ -180,7 +141,7 @@ func (oh *OpenSpyRedisInputHandler) Invoke(monitor Engine.SyncStatusMonitor, par
 	go func() {
 		select {
 		case <-oh.ctx.Done():
-			oh.monitor.EndServerListEngine(oh)
+			oh.monitor.EndServerListEngine(oh, context.Cause(oh.ctx))
 			oh.Shutdown()
 			return
 		}
@@ -188,5 +149,14 @@ func (oh *OpenSpyRedisInputHandler) Invoke(monitor Engine.SyncStatusMonitor, par
 }
 
 func (oh *OpenSpyRedisInputHandler) Shutdown() {
+	if oh.redisClient != nil {
+		oh.redisClient.Close() //a fresh client is set up on every Invoke
+	}
+}
 
+// A client is only held during Invoke, so check with a short lived one
+func (oh *OpenSpyRedisInputHandler) CheckHealth(ctx context.Context) error {
+	var client = redis.NewClient(getRedisOptions(oh.params.RedisParams))
+	defer client.Close()
+	return client.Ping(ctx).Err()
 }
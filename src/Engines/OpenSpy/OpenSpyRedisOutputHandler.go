@@ -2,35 +2,87 @@ package OpenSpy
 
 import (
 	"context"
-	"crypto/tls"
 	"fmt"
-	"log"
 	"net"
-	"os"
+	"net/netip"
+	"os-serverlist-sync/Engine"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
 type OpenSpyRedisOutputHandlerParams struct {
-	Gamename   string      `json:"gamename"`
-	InjectKeys interface{} `json:"injectKeys"`
+	RedisParams
+	Gamename       string      `json:"gamename" validate:"required"`
+	InjectKeys     interface{} `json:"injectKeys"`
+	RemoveTimedOut bool        `json:"remove_timed_out"` //remove injected servers once they stop responding, rather than when they expire
 }
 
 const (
 	SERVER_EXPIRE_TIME_SECS int = 900
+
+	//fields of the <server key>custkeys_meta hash holding how many player and team rows were last written,
+	//so rows a server no longer has are removed. Kept out of the server's own hash, which OpenSpy reads as is
+	PLAYER_ROWS_FIELD string = "player_rows"
+	TEAM_ROWS_FIELD   string = "team_rows"
 )
 
 type OpenSpyRedisOutputHandler struct {
+	Engine.LogContext
+	Engine.OutputLifecycleBase
+
 	params      *OpenSpyRedisOutputHandlerParams
 	redisClient *redis.Client
 	context     context.Context
 
 	gameId int
+
+	outputWrites atomic.Uint64
+	outputErrors atomic.Uint64
+}
+
+// The player and team hashes last written for a server
+type serverRows struct {
+	players int
+	teams   int
+}
+
+func getRowsMetaKey(server_key string) string {
+	return fmt.Sprintf("%scustkeys_meta", server_key)
+}
+
+// Reads the recorded row counts, zero for a server never written with rows
+func (oh *OpenSpyRedisOutputHandler) getServerRows(server_key string) (serverRows, error) {
+	values, err := oh.redisClient.HMGet(oh.context, getRowsMetaKey(server_key), PLAYER_ROWS_FIELD, TEAM_ROWS_FIELD).Result()
+	if err != nil {
+		return serverRows{}, err
+	}
+	var counts [2]int
+	for i, value := range values {
+		if text, ok := value.(string); ok {
+			counts[i], _ = strconv.Atoi(text)
+		}
+	}
+	return serverRows{players: counts[0], teams: counts[1]}, nil
+}
+
+// Deletes the rows numbered from up to previous, which the server no longer has
+func (oh *OpenSpyRedisOutputHandler) deleteRows(pipe redis.Pipeliner, server_key string, kind string, from int, previous int) {
+	for i := from; i < previous; i++ {
+		pipe.Del(oh.context, getRowKey(server_key, kind, i))
+	}
 }
 
 func (oh *OpenSpyRedisOutputHandler) OnServerInfoResponse(sourceAddress net.Addr, serverProperties map[string]string) {
+	oh.OnServerInfo(sourceAddress, &Engine.ServerInfo{Keys: serverProperties})
+}
+
+// Players and teams are written to a hash each, <server key>custkeys_player_<index> and custkeys_team_<index>
+func (oh *OpenSpyRedisOutputHandler) OnServerInfo(sourceAddress net.Addr, info *Engine.ServerInfo) {
+	var serverProperties = info.Keys
+
 	//var existing server key (or create) -- create IPMAP too
 	//create server keys
 	//mark as "injected" server
@@ -40,23 +92,18 @@ func (oh *OpenSpyRedisOutputHandler) OnServerInfoResponse(sourceAddress net.Addr
 
 	var udpAddr *net.UDPAddr = sourceAddress.(*net.UDPAddr)
 
-	var server_key = oh.getServerKey(udpAddr)
+	server_key, keyErr := oh.getServerKey(udpAddr)
+	if keyErr != nil {
+		oh.Logger().Error("Failed to get server key", "server", sourceAddress.String(), "error", keyErr)
+		oh.outputErrors.Add(1)
+		return
+	}
 
 	if server_key == nil { //this was not an injected server?? just ignore
 		return
 	}
 
-	log.Printf("Num keys (%s): %d (%s) (%s)\n", *server_key, len(serverProperties), sourceAddress.String(), fmt.Sprintf("%d", udpAddr.Port))
-
-	//setup standard keys
-	oh.redisClient.HSet(oh.context, *server_key, []string{
-		"wan_ip", udpAddr.IP.String(),
-		"wan_port", fmt.Sprintf("%d", udpAddr.Port),
-		//there is an id property... but is it needed / used?
-		"gameid", fmt.Sprintf("%d", oh.gameId),
-		"allow_unsolicited_udp", "1",
-		"injected", "1",
-	})
+	oh.Logger().Debug("Writing server", "server", sourceAddress.String(), "server_key", *server_key, "num_keys", len(serverProperties))
 
 	if oh.params.InjectKeys != nil {
 		for k, v := range oh.params.InjectKeys.(map[string]interface{}) {
@@ -64,61 +111,130 @@ func (oh *OpenSpyRedisOutputHandler) OnServerInfoResponse(sourceAddress net.Addr
 		}
 	}
 
-	//setup custom keys
 	var custkeys_name = fmt.Sprintf("%scustkeys", *server_key)
-	oh.redisClient.HSet(oh.context, custkeys_name, serverProperties)
+	var ipmap_name = fmt.Sprintf("IPMAP_%s-%d", getWanIP(udpAddr), udpAddr.Port)
 
-	oh.redisClient.Expire(oh.context, *server_key, time.Duration(SERVER_EXPIRE_TIME_SECS)*time.Second)
-	oh.redisClient.Expire(oh.context, custkeys_name, time.Duration(SERVER_EXPIRE_TIME_SECS)*time.Second)
+	previous, err := oh.getServerRows(*server_key)
+	if err != nil {
+		oh.Logger().Error("Failed to read server rows", "server", sourceAddress.String(), "error", err)
+		oh.outputErrors.Add(1)
+		return
+	}
 
-	var ipmap_name = fmt.Sprintf("IPMAP_%s-%d", udpAddr.IP.String(), udpAddr.Port)
-	oh.redisClient.Set(oh.context, ipmap_name, *server_key, time.Duration(SERVER_EXPIRE_TIME_SECS)*time.Second)
-	oh.redisClient.Expire(oh.context, ipmap_name, time.Duration(SERVER_EXPIRE_TIME_SECS)*time.Second)
+	//pipelined so the writes go out in one round trip, and any failure is reported
+	_, err = oh.redisClient.Pipelined(oh.context, func(pipe redis.Pipeliner) error {
+		//setup standard keys
+		pipe.HSet(oh.context, *server_key, []string{
+			"wan_ip", getWanIP(udpAddr),
+			"wan_port", fmt.Sprintf("%d", udpAddr.Port),
+			//there is an id property... but is it needed / used?
+			"gameid", fmt.Sprintf("%d", oh.gameId),
+			"allow_unsolicited_udp", "1",
+			"injected", "1",
+		})
 
-	oh.redisClient.ZIncrBy(oh.context, oh.params.Gamename, 1.0, *server_key)
-}
+		//setup custom keys
+		pipe.HSet(oh.context, custkeys_name, serverProperties)
 
-func (oh *OpenSpyRedisOutputHandler) SetParams(params interface{}) {
+		pipe.Expire(oh.context, *server_key, time.Duration(SERVER_EXPIRE_TIME_SECS)*time.Second)
+		pipe.Expire(oh.context, custkeys_name, time.Duration(SERVER_EXPIRE_TIME_SECS)*time.Second)
+
+		pipe.Set(oh.context, ipmap_name, *server_key, time.Duration(SERVER_EXPIRE_TIME_SECS)*time.Second)
+		pipe.Expire(oh.context, ipmap_name, time.Duration(SERVER_EXPIRE_TIME_SECS)*time.Second)
+
+		pipe.ZIncrBy(oh.context, oh.params.Gamename, 1.0, *server_key)
+
+		for i, player := range info.Players {
+			oh.writeRow(pipe, getRowKey(*server_key, "player", i), player.Keys)
+		}
+		for i, team := range info.Teams {
+			oh.writeRow(pipe, getRowKey(*server_key, "team", i), team.Keys)
+		}
+		oh.deleteRows(pipe, *server_key, "player", len(info.Players), previous.players)
+		oh.deleteRows(pipe, *server_key, "team", len(info.Teams), previous.teams)
+
+		var rows_meta_name = getRowsMetaKey(*server_key)
+		pipe.HSet(oh.context, rows_meta_name, PLAYER_ROWS_FIELD, len(info.Players), TEAM_ROWS_FIELD, len(info.Teams))
+		pipe.Expire(oh.context, rows_meta_name, time.Duration(SERVER_EXPIRE_TIME_SECS)*time.Second)
+		return nil
+	})
 
-	redisOptions := &redis.Options{
-		Addr: os.Getenv("REDIS_SERVER"),
+	if err != nil {
+		oh.Logger().Error("Failed to write server", "server", sourceAddress.String(), "error", err)
+		oh.outputErrors.Add(1)
+		return
 	}
+	oh.outputWrites.Add(1)
+}
 
-	redisUsername := os.Getenv("REDIS_USERNAME")
-	redisPassword := os.Getenv("REDIS_PASSWORD")
+func getRowKey(server_key string, kind string, index int) string {
+	return fmt.Sprintf("%scustkeys_%s_%d", server_key, kind, index)
+}
 
-	if len(redisUsername) > 0 {
-		redisOptions.Username = redisUsername
+// Replaces the row's hash, it expires with the server
+func (oh *OpenSpyRedisOutputHandler) writeRow(pipe redis.Pipeliner, row_key string, keys map[string]string) {
+	pipe.Del(oh.context, row_key)
+	if len(keys) == 0 {
+		return
 	}
-	if len(redisPassword) > 0 {
-		redisOptions.Password = redisPassword
+	pipe.HSet(oh.context, row_key, keys)
+	pipe.Expire(oh.context, row_key, time.Duration(SERVER_EXPIRE_TIME_SECS)*time.Second)
+}
+
+func (oh *OpenSpyRedisOutputHandler) OnServerTimeout(address netip.AddrPort) {
+	if !oh.params.RemoveTimedOut {
+		return
 	}
 
-	redisUseTLS := os.Getenv("REDIS_USE_TLS")
+	var ipmap_name = fmt.Sprintf("IPMAP_%s-%d", Engine.NormalizeAddrPort(address).Addr().String(), address.Port())
+	server_key, err := oh.redisClient.Get(oh.context, ipmap_name).Result()
+	if err == redis.Nil { //never written, or already expired
+		return
+	}
+	if err == nil {
+		var injected bool
+		injected, err = oh.redisClient.HExists(oh.context, server_key, "injected").Result()
+		if err == nil && !injected { //the server reports itself, it isn't ours to remove
+			return
+		}
+	}
 
-	if len(redisUseTLS) > 0 {
-		useTLSInt, _ := strconv.Atoi(redisUseTLS)
+	var rows serverRows
+	if err == nil {
+		rows, err = oh.getServerRows(server_key)
+	}
+	if err == nil {
+		_, err = oh.redisClient.Pipelined(oh.context, func(pipe redis.Pipeliner) error {
+			pipe.Del(oh.context, server_key, fmt.Sprintf("%scustkeys", server_key), getRowsMetaKey(server_key), ipmap_name)
+			pipe.ZRem(oh.context, oh.params.Gamename, server_key)
+			oh.deleteRows(pipe, server_key, "player", 0, rows.players)
+			oh.deleteRows(pipe, server_key, "team", 0, rows.teams)
+			return nil
+		})
+	}
+	if err != nil {
+		oh.Logger().Error("Failed to remove timed out server", "server", address.String(), "error", err)
+		oh.outputErrors.Add(1)
+		return
+	}
+	oh.Logger().Debug("Removed timed out server", "server", address.String(), "server_key", server_key)
+}
 
-		if useTLSInt == 1 {
-			tlsConfig := &tls.Config{
-				MinVersion: tls.VersionTLS12,
-				//InsecureSkipVerify: true,
-				//Certificates: []tls.Certificate{cert}
-			}
+func (oh *OpenSpyRedisOutputHandler) GetOutputStats() Engine.OutputStats {
+	return Engine.OutputStats{
+		Writes: oh.outputWrites.Load(),
+		Errors: oh.outputErrors.Load(),
+	}
+}
 
-			redisSkipSSLVerify := os.Getenv("REDIS_INSECURE_TLS")
-			if len(redisSkipSSLVerify) > 0 {
-				useInsecureTLS, _ := strconv.Atoi(redisSkipSSLVerify)
+// IPv6 addresses are stored unbracketed
+func getWanIP(udpAddr *net.UDPAddr) string {
+	return Engine.NormalizeAddrPort(udpAddr.AddrPort()).Addr().String()
+}
 
-				if useInsecureTLS == 1 {
-					tlsConfig.InsecureSkipVerify = true
-				}
-			}
-			redisOptions.TLSConfig = tlsConfig
-		}
-	}
+func (oh *OpenSpyRedisOutputHandler) SetParams(params interface{}) {
 
-	redisOptions.DB = 0
+	redisOptions := getRedisOptions(params.(*OpenSpyRedisOutputHandlerParams).RedisParams)
 	rdb := redis.NewClient(redisOptions)
 
 	oh.context = context.Background()
@@ -155,12 +271,15 @@ This will first:
 		if no key found
 			create key + ip map, set as injected, and return server key
 */
-func (oh *OpenSpyRedisOutputHandler) getServerKey(udpAddr *net.UDPAddr) *string {
+func (oh *OpenSpyRedisOutputHandler) getServerKey(udpAddr *net.UDPAddr) (*string, error) {
 
 	var server_key string
 
-	var ipmap_name = fmt.Sprintf("IPMAP_%s-%d", udpAddr.IP.String(), udpAddr.Port)
-	existsResult, _ := oh.redisClient.Exists(oh.context, ipmap_name).Result()
+	var ipmap_name = fmt.Sprintf("IPMAP_%s-%d", getWanIP(udpAddr), udpAddr.Port)
+	existsResult, err := oh.redisClient.Exists(oh.context, ipmap_name).Result()
+	if err != nil {
+		return nil, err
+	}
 
 	if existsResult != 0 {
 
@@ -169,21 +288,33 @@ func (oh *OpenSpyRedisOutputHandler) getServerKey(udpAddr *net.UDPAddr) *string
 		//check if the server is injected
 		injectedResponse, _ := oh.redisClient.HExists(oh.context, server_key, "injected").Result()
 		if !injectedResponse {
-			return nil
+			return nil, nil
 		}
 
-		return &server_key
+		return &server_key, nil
 	}
 
 	result, err := oh.redisClient.Incr(oh.context, "QRID").Result()
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	server_key = fmt.Sprintf("%s_injected:%d:", oh.params.Gamename, result)
 
-	return &server_key
+	return &server_key, nil
 
 }
+func (oh *OpenSpyRedisOutputHandler) GetRedisParams() RedisParams {
+	return oh.params.RedisParams
+}
+
 func (oh *OpenSpyRedisOutputHandler) GetGamename() string {
 	return oh.params.Gamename
 }
+
+func (oh *OpenSpyRedisOutputHandler) CheckHealth(ctx context.Context) error {
+	return oh.redisClient.Ping(ctx).Err()
+}
+
+func (p *OpenSpyRedisOutputHandlerParams) ValidateParams() []Engine.ParamError {
+	return p.RedisParams.Check()
+}
@@ -0,0 +1,99 @@
+package OpenSpy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"os-serverlist-sync/Engine"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Optional Redis connection params, each one overrides its REDIS_* environment variable when set
+type RedisParams struct {
+	Server   string `json:"redis_server" validate:"hostport"`
+	Username string `json:"redis_username" secret:"true"`
+	Password string `json:"redis_password" secret:"true"`
+}
+
+func (p RedisParams) getServer() string {
+	if len(p.Server) > 0 {
+		return p.Server
+	}
+	return os.Getenv("REDIS_SERVER")
+}
+
+// Connection options for the OpenSpy servers database, shared by the input and output handlers
+func getRedisOptions(params RedisParams) *redis.Options {
+	redisOptions := &redis.Options{
+		Addr: params.getServer(),
+	}
+
+	redisUsername := os.Getenv("REDIS_USERNAME")
+	redisPassword := os.Getenv("REDIS_PASSWORD")
+	if len(params.Username) > 0 {
+		redisUsername = params.Username
+	}
+	if len(params.Password) > 0 {
+		redisPassword = params.Password
+	}
+
+	if len(redisUsername) > 0 {
+		redisOptions.Username = redisUsername
+	}
+	if len(redisPassword) > 0 {
+		redisOptions.Password = redisPassword
+	}
+
+	redisUseTLS := os.Getenv("REDIS_USE_TLS")
+
+	if len(redisUseTLS) > 0 {
+		useTLSInt, _ := strconv.Atoi(redisUseTLS)
+
+		if useTLSInt == 1 {
+			tlsConfig := &tls.Config{
+				MinVersion: tls.VersionTLS12,
+				//InsecureSkipVerify: true,
+				//Certificates: []tls.Certificate{cert}
+			}
+
+			redisSkipSSLVerify := os.Getenv("REDIS_INSECURE_TLS")
+			if len(redisSkipSSLVerify) > 0 {
+				useInsecureTLS, _ := strconv.Atoi(redisSkipSSLVerify)
+
+				if useInsecureTLS == 1 {
+					tlsConfig.InsecureSkipVerify = true
+				}
+			}
+			redisOptions.TLSConfig = tlsConfig
+		}
+	}
+
+	redisOptions.DB = 0
+	return redisOptions
+}
+
+// Checks the settings getRedisOptions reads, redis_server itself is checked by its validate tag
+func (p RedisParams) Check() []Engine.ParamError {
+	var errors []Engine.ParamError
+
+	if len(p.Server) == 0 {
+		redisServer := os.Getenv("REDIS_SERVER")
+		if len(redisServer) == 0 {
+			errors = append(errors, Engine.ParamError{Field: "redis_server", Message: "is required when the REDIS_SERVER environment variable is not set"})
+		} else if _, _, err := net.SplitHostPort(redisServer); err != nil {
+			errors = append(errors, Engine.ParamError{Message: fmt.Sprintf("REDIS_SERVER %q is not a host:port address", redisServer)})
+		}
+	}
+
+	for _, name := range []string{"REDIS_USE_TLS", "REDIS_INSECURE_TLS"} {
+		if value := os.Getenv(name); len(value) > 0 {
+			if _, err := strconv.Atoi(value); err != nil {
+				errors = append(errors, Engine.ParamError{Message: fmt.Sprintf("%s %q is not a number", name, value)})
+			}
+		}
+	}
+	return errors
+}
@@ -0,0 +1,10 @@
+package OpenSpy
+
+import "os-serverlist-sync/Engine"
+
+// OpenSpyRedisInputHandler isn't registered, it only replaces the configured list engines with --refresh-only
+func init() {
+	Engine.RegisterOutputHandler("OSRedisOutput",
+		func() interface{} { return new(OpenSpyRedisOutputHandlerParams) },
+		func() Engine.IQueryOutputHandler { return &OpenSpyRedisOutputHandler{} })
+}
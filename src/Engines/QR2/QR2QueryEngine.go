@@ -1,29 +1,48 @@
 package QR2
 
-/*
-	TODO: pre-query ip verify
-	player keys
-	team keys
-*/
-
 import (
-	"log"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
 	"net"
 	"net/netip"
-	"os"
 	"os-serverlist-sync/Engine"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	QR2_PACKET_QUERY     byte = 0x00
+	QR2_PACKET_CHALLENGE byte = 0x09
+
+	QR2_SPLIT_SUPPORTED byte   = 0x01 //last byte of the query, lets servers split large responses over several packets
+	QR2_SPLIT_HEADER    string = "splitnum\x00"
+	QR2_SPLIT_LAST      byte   = 0x80 //set in the packet number of the last packet
+
+	QR2_SECTION_SERVER  byte = 0x00
+	QR2_SECTION_PLAYERS byte = 0x01
+	QR2_SECTION_TEAMS   byte = 0x02
+
+	PREQUERY_CHALLENGE_TIMEOUT = 1 * time.Second //how long a challenge waits for its reply before a plain query is sent
 )
 
 type QueryEngineParams struct {
-	PrequeryIpVerify bool   `json:"prequery_ip_verify"`
-	SourcePort       uint16 `json:"source_port"`
+	Engine.UDPSocketParams
+	PrequeryIpVerify bool `json:"prequery_ip_verify"` //servers which verify the querying IP only answer a query carrying their challenge token
 }
 
 type QueryEngine struct {
+	Engine.LogContext
+
 	params        *QueryEngineParams
-	connection    *net.UDPConn
+	socket        *Engine.UDPSocket
 	outputHandler Engine.IQueryOutputHandler
-	monitor       Engine.SyncStatusMonitor
+	monitor       atomic.Pointer[Engine.SyncStatusMonitor]
+	bindError     error
+	splitPackets  *Engine.ServerInfoAssembler
 }
 
 // Since this is UDP, do not associate the state with the engine itself! only pass by args!
@@ -35,22 +54,15 @@ type QueryParserState struct {
 
 func (qe *QueryEngine) SetParams(params interface{}) {
 	qe.params = params.(*QueryEngineParams)
+	qe.splitPackets = Engine.NewServerInfoAssembler("qr2", isSplitComplete, qe.writeServerInfo)
 
-	addr := net.UDPAddr{
-		Port: int(qe.params.SourcePort),
-		IP:   net.ParseIP("0.0.0.0"),
-	}
-	ser, err := net.ListenUDP("udp", &addr)
+	socket, err := Engine.OpenUDPSocket(qe.params.UDPSocketParams, qe)
 	if err != nil {
-		log.Println("QR2 QueryEngine bind failed:", err.Error())
-		os.Exit(1)
+		qe.Logger().Error("Query engine bind failed", "source_port", qe.params.SourcePort, "error", err)
+		qe.bindError = err
+		return
 	}
-
-	qe.connection = ser
-
-	go func() {
-		qe.listen()
-	}()
+	qe.socket = socket
 }
 
 func (qe *QueryEngine) SetOutputHandler(handler Engine.IQueryOutputHandler) {
@@ -58,14 +70,82 @@ func (qe *QueryEngine) SetOutputHandler(handler Engine.IQueryOutputHandler) {
 }
 
 func (qe *QueryEngine) Query(destination netip.AddrPort) {
-	var addr = net.UDPAddrFromAddrPort(destination)
-	log.Printf("QR2 Send query to: %s\n", addr.String())
-	writeBuffer := make([]byte, 11)
+	if qe.socket == nil {
+		return
+	}
+	if !qe.params.PrequeryIpVerify {
+		qe.sendQuery(destination, nil)
+		return
+	}
+
+	qe.Logger().Debug("Send challenge", "server", destination.String())
+	writeBuffer := make([]byte, 7)
 	writeBuffer[0] = 0xfe
 	writeBuffer[1] = 0xfd
-	writeBuffer[7] = 0xff
+	writeBuffer[2] = QR2_PACKET_CHALLENGE
+
+	qe.socket.WriteTo(writeBuffer, destination)
+
+	//servers which don't implement the challenge never reply to it, they get a plain query if this attempt
+	//is still unanswered shortly after rather than waiting for the monitor's retry
+	var monitor = qe.monitor.Load()
+	if monitor == nil {
+		return
+	}
+	var attempt = monitor.GetQueryAttempts(qe, destination)
+	time.AfterFunc(PREQUERY_CHALLENGE_TIMEOUT, func() {
+		if monitor.GetQueryAttempts(qe, destination) != attempt { //answered, abandoned or already retried
+			return
+		}
+		qe.Logger().Debug("No challenge reply, sending plain query", "server", destination.String())
+		qe.sendQuery(destination, nil)
+	})
+}
+
+// The challenge, then either the query carrying its token or the plain query sent when it isn't answered
+func (qe *QueryEngine) PacketsPerQuery() int {
+	if qe.params != nil && qe.params.PrequeryIpVerify {
+		return 2
+	}
+	return 1
+}
+
+// Sends the full query, with the challenge token between the instance key and the requested keys when given
+func (qe *QueryEngine) sendQuery(destination netip.AddrPort, token []byte) {
+	qe.Logger().Debug("Send query", "server", destination.String())
+	writeBuffer := make([]byte, 0, 15)
+	writeBuffer = append(writeBuffer, 0xfe, 0xfd, QR2_PACKET_QUERY)
+	writeBuffer = append(writeBuffer, 0, 0, 0, 0) //instance key
+	writeBuffer = append(writeBuffer, token...)
+	writeBuffer = append(writeBuffer, 0xff) //all server keys
+	writeBuffer = append(writeBuffer, 0xff) //all player keys
+	writeBuffer = append(writeBuffer, 0xff) //all team keys
+	writeBuffer = append(writeBuffer, QR2_SPLIT_SUPPORTED)
+
+	qe.socket.WriteTo(writeBuffer, destination)
+}
 
-	qe.connection.WriteToUDP(writeBuffer, addr)
+/*
+Challenge replies carry the token as a NUL terminated decimal string after the instance key. The query
+sends it back as a big-endian uint32, some servers reply with values which only fit once wrapped.
+*/
+func (qe *QueryEngine) handleChallenge(addr *net.UDPAddr, packet []byte) {
+	var destination = Engine.NormalizeAddrPort(addr.AddrPort())
+	if monitor := qe.monitor.Load(); monitor != nil && monitor.GetQueryAttempts(qe, destination) == 0 {
+		return //a late reply to a query which has since completed or been abandoned
+	}
+
+	var state = QueryParserState{TotalLength: len(packet), CurrentOffset: 5, Buffer: packet}
+	var tokenString = qe.readString(&state)
+	value, err := strconv.ParseInt(tokenString, 10, 64)
+	if err != nil {
+		qe.Logger().Warn("Invalid challenge reply, sending plain query", "server", destination.String(), "token", tokenString)
+		qe.sendQuery(destination, nil)
+		return
+	}
+
+	var token = binary.BigEndian.AppendUint32(nil, uint32(value))
+	qe.sendQuery(destination, token)
 }
 
 func (qe *QueryEngine) readString(state *QueryParserState) string {
@@ -84,51 +164,261 @@ func (qe *QueryEngine) readString(state *QueryParserState) string {
 	return stringData
 }
 
-func (qe *QueryEngine) listen() {
-	defer qe.connection.Close()
+/*
+Reads the player or team section of a response: a big-endian row count, the key names (player_, score_)
+ended by an empty name, then each row's values in key order. Rows cut off by the end of the packet
+are dropped, a response without the section has no rows.
+*/
+func (qe *QueryEngine) readSection(state *QueryParserState) ([]string, [][]string) {
+	if state.CurrentOffset+2 > state.TotalLength {
+		return nil, nil
+	}
+	var count = int(binary.BigEndian.Uint16(state.Buffer[state.CurrentOffset:]))
+	state.CurrentOffset += 2
 
-	buf := make([]byte, 1492)
-	for {
-		bufLen, addr, err := qe.connection.ReadFrom(buf)
-		if err != nil {
-			log.Println("QR2 Recvfrom failed:", err.Error())
+	var keys []string
+	for state.CurrentOffset < state.TotalLength {
+		var key = qe.readString(state)
+		if len(key) == 0 {
 			break
 		}
+		keys = append(keys, key)
+	}
 
-		if bufLen < 6 {
-			continue
+	var rows [][]string
+	for i := 0; i < count && state.CurrentOffset < state.TotalLength; i++ {
+		var row = make([]string, len(keys))
+		for j := range keys {
+			if state.CurrentOffset >= state.TotalLength {
+				return keys, rows
+			}
+			row[j] = qe.readString(state)
+		}
+		rows = append(rows, row)
+	}
+	return keys, rows
+}
+
+// Query and challenge responses start with their packet type and the instance key sent, which is zero
+func (qe *QueryEngine) MatchesPacket(packet []byte) bool {
+	return len(packet) >= 5 && (packet[0] == QR2_PACKET_QUERY || packet[0] == QR2_PACKET_CHALLENGE) &&
+		packet[1] == 0 && packet[2] == 0 && packet[3] == 0 && packet[4] == 0
+}
+
+func (qe *QueryEngine) HandlePacket(addr *net.UDPAddr, packet []byte) {
+	if len(packet) < 6 {
+		return
+	}
+	if packet[0] == QR2_PACKET_CHALLENGE {
+		qe.handleChallenge(addr, packet)
+		return
+	}
+	if bytes.HasPrefix(packet[5:], []byte(QR2_SPLIT_HEADER)) {
+		qe.handleSplitPacket(addr, packet)
+		return
+	}
+
+	propMap := make(map[string]string)
+
+	var state QueryParserState
+	state.Buffer = packet
+
+	state.TotalLength = len(packet)
+	state.CurrentOffset = 5 //skip key data for now
+
+	//server keys, ended by an empty key with no value
+	for state.CurrentOffset < state.TotalLength {
+		var serverKey = qe.readString(&state)
+		if len(serverKey) == 0 {
+			break
 		}
+		propMap[serverKey] = qe.readString(&state)
+	}
+
+	//server keys are sent as they are, so they are also the rules
+	var info = &Engine.ServerInfo{Protocol: "qr2", Keys: propMap, Rules: make(map[string]string, len(propMap))}
+	for k, v := range propMap {
+		info.Rules[k] = v
+	}
+
+	keys, rows := qe.readSection(&state)
+	for _, row := range rows {
+		var player = Engine.NewPlayerInfo()
+		for i, key := range keys {
+			player.SetKey(key, row[i])
+		}
+		info.Players = append(info.Players, *player)
+	}
+
+	keys, rows = qe.readSection(&state)
+	for _, row := range rows {
+		var team = Engine.NewTeamInfo()
+		for i, key := range keys {
+			team.SetKey(key, row[i])
+		}
+		info.Teams = append(info.Teams, *team)
+	}
+
+	info.RTT, _ = qe.getQueryRTT(addr.AddrPort())
+	qe.writeServerInfo(addr.AddrPort(), info)
+}
+
+// A player or team key from a split response, with the values of the rows from offset on
+type splitField struct {
+	key    string
+	offset int
+	values []string
+}
 
-		propMap := make(map[string]string)
-		var udpAddr *net.UDPAddr = addr.(*net.UDPAddr)
+/*
+Handles one packet of a split response: the split header, a packet number with QR2_SPLIT_LAST set on the
+last packet, then sections each starting with their QR2_SECTION_ byte. The server section is key and value
+pairs ended by an empty key, the player and team sections are keys each followed by the row offset its
+values start at and the values, ended by an empty value. The packets may arrive in any order.
+*/
+func (qe *QueryEngine) handleSplitPacket(addr *net.UDPAddr, packet []byte) {
+	var state = QueryParserState{TotalLength: len(packet), CurrentOffset: 5 + len(QR2_SPLIT_HEADER), Buffer: packet}
+	if state.CurrentOffset >= state.TotalLength {
+		return
+	}
+	var packetNumber = packet[state.CurrentOffset]
+	state.CurrentOffset++
 
-		var state QueryParserState
-		state.Buffer = buf
+	var keys = make(map[string]string)
+	var players, teams []splitField
+	for state.CurrentOffset < state.TotalLength {
+		var section = packet[state.CurrentOffset]
+		state.CurrentOffset++
 
-		state.TotalLength = bufLen
-		state.CurrentOffset = 5 //skip key data for now
+		switch section {
+		case QR2_SECTION_SERVER:
+			for state.CurrentOffset < state.TotalLength {
+				var serverKey = qe.readString(&state)
+				if len(serverKey) == 0 {
+					break
+				}
+				keys[serverKey] = qe.readString(&state)
+			}
+		case QR2_SECTION_PLAYERS:
+			players = append(players, qe.readSplitFields(&state)...)
+		case QR2_SECTION_TEAMS:
+			teams = append(teams, qe.readSplitFields(&state)...)
+		default:
+			qe.Logger().Debug("Unexpected split response section", "server", addr.String(), "section", section)
+			state.CurrentOffset = state.TotalLength
+		}
+	}
+
+	var part = fmt.Sprintf("packet:%d", packetNumber&^QR2_SPLIT_LAST)
+	if packetNumber&QR2_SPLIT_LAST != 0 {
+		part = fmt.Sprintf("last:%d", packetNumber&^QR2_SPLIT_LAST)
+	}
+
+	rtt, _ := qe.getQueryRTT(addr.AddrPort())
+	qe.splitPackets.Add(addr.AddrPort(), part, func(info *Engine.ServerInfo) {
+		if info.RTT == 0 {
+			info.RTT = rtt
+		}
+		if info.Rules == nil {
+			info.Rules = make(map[string]string)
+		}
+		for k, v := range keys { //server keys are sent as they are, so they are also the rules
+			info.Keys[k] = v
+			info.Rules[k] = v
+		}
+		for _, field := range players {
+			for i, value := range field.values {
+				for len(info.Players) <= field.offset+i {
+					info.Players = append(info.Players, *Engine.NewPlayerInfo())
+				}
+				info.Players[field.offset+i].SetKey(field.key, value)
+			}
+		}
+		for _, field := range teams {
+			for i, value := range field.values {
+				for len(info.Teams) <= field.offset+i {
+					info.Teams = append(info.Teams, *Engine.NewTeamInfo())
+				}
+				info.Teams[field.offset+i].SetKey(field.key, value)
+			}
+		}
+	})
+}
 
-		for {
-			var serverKey = qe.readString(&state)
-			var serverValue = qe.readString(&state)
+// Reads a split player or team section, ended by an empty key
+func (qe *QueryEngine) readSplitFields(state *QueryParserState) []splitField {
+	var fields []splitField
+	for state.CurrentOffset < state.TotalLength {
+		var key = qe.readString(state)
+		if len(key) == 0 || state.CurrentOffset >= state.TotalLength {
+			break
+		}
+		var field = splitField{key: key, offset: int(state.Buffer[state.CurrentOffset])}
+		state.CurrentOffset++
 
-			if len(serverKey) == 0 {
+		for state.CurrentOffset < state.TotalLength {
+			var value = qe.readString(state)
+			if len(value) == 0 {
 				break
 			}
-			propMap[serverKey] = serverValue
+			field.values = append(field.values, value)
 		}
+		fields = append(fields, field)
+	}
+	return fields
+}
 
-		if qe.outputHandler != nil {
-			qe.outputHandler.OnServerInfoResponse(addr, propMap)
+// Complete once the last packet and every packet numbered before it have arrived
+func isSplitComplete(info *Engine.ServerInfo, received map[string]bool) bool {
+	for part := range received {
+		last, found := strings.CutPrefix(part, "last:")
+		if !found {
+			continue
+		}
+		count, _ := strconv.Atoi(last)
+		for i := 0; i < count; i++ {
+			if !received[fmt.Sprintf("packet:%d", i)] {
+				return false
+			}
 		}
-		qe.monitor.CompleteQuery(qe, udpAddr.AddrPort())
+		return true
+	}
+	return false
+}
+
+func (qe *QueryEngine) getQueryRTT(address netip.AddrPort) (time.Duration, bool) {
+	if monitor := qe.monitor.Load(); monitor != nil {
+		return monitor.GetQueryRTT(qe, address)
+	}
+	return 0, false
+}
+
+func (qe *QueryEngine) writeServerInfo(address netip.AddrPort, info *Engine.ServerInfo) {
+	var monitor = qe.monitor.Load()
+	if monitor != nil && monitor.GetQueryAttempts(qe, address) == 0 {
+		return //a late response to a completed or abandoned query, or a second answer to the same one
+	}
+	if qe.outputHandler != nil {
+		Engine.WriteServerInfo(qe.outputHandler, net.UDPAddrFromAddrPort(address), info)
+	}
+	if monitor != nil {
+		monitor.CompleteQuery(qe, address)
 	}
 }
 
 func (qe *QueryEngine) Shutdown() {
-	qe.connection.Close()
+	if qe.splitPackets != nil {
+		qe.splitPackets.Clear()
+	}
+	if qe.socket != nil {
+		qe.socket.Close()
+	}
+}
+
+func (qe *QueryEngine) CheckHealth(ctx context.Context) error {
+	return qe.bindError
 }
 
-func (qe *QueryEngine) SetMonitor(monitor Engine.SyncStatusMonitor) {
-	qe.monitor = monitor
+func (qe *QueryEngine) SetMonitor(monitor *Engine.SyncStatusMonitor) {
+	qe.monitor.Store(monitor)
 }
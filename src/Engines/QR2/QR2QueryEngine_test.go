@@ -0,0 +1,126 @@
+package QR2
+
+import (
+	"net"
+	"os-serverlist-sync/Engine"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReadSection(t *testing.T) {
+	var tests = []struct {
+		name    string
+		section string
+		rest    string //the next section, which must be left unread
+		keys    []string
+		rows    [][]string
+	}{
+		{
+			name:    "rows",
+			section: "\x00\x02player_\x00score_\x00\x00alice\x0010\x00bob\x005\x00",
+			rest:    "\x00\x01team_t\x00\x00red\x00",
+			keys:    []string{"player_", "score_"},
+			rows:    [][]string{{"alice", "10"}, {"bob", "5"}},
+		},
+		{
+			name:    "zero count",
+			section: "\x00\x00player_\x00score_\x00\x00",
+			rest:    "\x00\x00team_t\x00\x00",
+			keys:    []string{"player_", "score_"},
+		},
+		{
+			name:    "truncated",
+			section: "\x00\x03player_\x00score_\x00\x00alice\x0010\x00bob",
+			keys:    []string{"player_", "score_"},
+			rows:    [][]string{{"alice", "10"}},
+		},
+		{
+			name:    "missing",
+			section: "",
+		},
+		{
+			name:    "count cut off",
+			section: "\x00",
+		},
+	}
+
+	var qe = &QueryEngine{}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var packet = []byte(test.section + test.rest)
+			var state = QueryParserState{Buffer: packet, TotalLength: len(packet)}
+			keys, rows := qe.readSection(&state)
+
+			if !reflect.DeepEqual(keys, test.keys) {
+				t.Errorf("got keys %q, want %q", keys, test.keys)
+			}
+			if !reflect.DeepEqual(rows, test.rows) {
+				t.Errorf("got rows %q, want %q", rows, test.rows)
+			}
+			if len(test.rest) > 0 && state.CurrentOffset != len(test.section) {
+				t.Errorf("got offset %d, want %d", state.CurrentOffset, len(test.section))
+			}
+		})
+	}
+}
+
+type fakeOutputHandler struct {
+	written chan *Engine.ServerInfo
+}
+
+func (h *fakeOutputHandler) OnServerInfoResponse(sourceAddress net.Addr, serverProperties map[string]string) {
+}
+
+func (h *fakeOutputHandler) OnServerInfo(sourceAddress net.Addr, info *Engine.ServerInfo) {
+	h.written <- info
+}
+
+func (h *fakeOutputHandler) SetParams(params interface{}) {
+}
+
+func TestSplitResponse(t *testing.T) {
+	var handler = &fakeOutputHandler{written: make(chan *Engine.ServerInfo, 1)}
+	var qe = &QueryEngine{}
+	qe.splitPackets = Engine.NewServerInfoAssembler("qr2", isSplitComplete, qe.writeServerInfo)
+	qe.SetOutputHandler(handler)
+
+	var header = "\x00\x00\x00\x00\x00" + QR2_SPLIT_HEADER
+	var packets = []string{
+		//the last packet first: the third player's name, every score from offset 0, then the teams
+		header + "\x81" +
+			"\x01player_\x00\x02carol\x00\x00score_\x00\x0010\x0020\x0030\x00\x00\x00" +
+			"\x02team_t\x00\x00red\x00blue\x00\x00\x00",
+		header + "\x00" +
+			"\x00hostname\x00server\x00numplayers\x003\x00\x00" +
+			"\x01player_\x00\x00alice\x00bob\x00\x00\x00",
+	}
+	var address = &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 27900}
+	for _, packet := range packets {
+		if !qe.MatchesPacket([]byte(packet)) {
+			t.Fatalf("packet %q not matched", packet)
+		}
+		qe.HandlePacket(address, []byte(packet))
+	}
+
+	var info *Engine.ServerInfo
+	select {
+	case info = <-handler.written:
+	case <-time.After(Engine.SERVER_INFO_ASSEMBLY_TIMEOUT / 2): //sooner than the assembler's timeout
+		t.Fatal("server info not written once every packet arrived")
+	}
+
+	if info.Keys["hostname"] != "server" || info.Rules["numplayers"] != "3" {
+		t.Errorf("got keys %v, rules %v", info.Keys, info.Rules)
+	}
+	var players []string
+	for _, player := range info.Players {
+		players = append(players, player.Name+":"+player.Keys["score_"])
+	}
+	if want := []string{"alice:10", "bob:20", "carol:30"}; !reflect.DeepEqual(players, want) {
+		t.Errorf("got players %q, want %q", players, want)
+	}
+	if len(info.Teams) != 2 || info.Teams[0].Name != "red" || info.Teams[1].Name != "blue" {
+		t.Errorf("got teams %v", info.Teams)
+	}
+}
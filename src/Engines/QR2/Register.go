@@ -0,0 +1,13 @@
+package QR2
+
+import "os-serverlist-sync/Engine"
+
+func init() {
+	Engine.RegisterServerListEngine("sbv2",
+		func() interface{} { return new(ServerListEngineParams) },
+		func() Engine.IServerListEngine { return &ServerListEngine{} })
+
+	Engine.RegisterQueryEngine("qr2",
+		func() interface{} { return new(QueryEngineParams) },
+		func() Engine.IQueryEngine { return &QueryEngine{} })
+}
@@ -9,7 +9,6 @@ import (
 	"context"
 	"encoding/binary"
 	"errors"
-	"log"
 	"net"
 	"net/netip"
 	"os-serverlist-sync/Engine"
@@ -39,20 +38,22 @@ const (
 )
 
 type ServerListEngineParams struct {
-	ServerAddress string `json:"address"`
-	Gamename      string `json:"gamename"`
-	Secretkey     string `json:"secretkey"`
-	QueryGamename string `json:"query_gamename"`
+	ServerAddress string `json:"address" validate:"required,hostport"`
+	Gamename      string `json:"gamename" validate:"required"`
+	Secretkey     string `json:"secretkey" validate:"required" secret:"true"`
+	QueryGamename string `json:"query_gamename" validate:"required"`
 
 	//we don't want fields really... but we need to query them since some MSes won't send a proper response without it
 	Fields string `json:"fields"`
 }
 
 type ServerListEngine struct {
+	Engine.LogContext
+
 	connection    *net.TCPConn
 	queryEngine   Engine.IQueryEngine
 	params        *ServerListEngineParams
-	monitor       Engine.SyncStatusMonitor
+	monitor       *Engine.SyncStatusMonitor
 	challenge     []byte
 	enctypeXData  unsafe.Pointer
 	enctypeXReady bool
@@ -75,7 +76,7 @@ func (se *ServerListEngine) SetParams(params interface{}) {
 	se.params = params.(*ServerListEngineParams)
 }
 
-func (se *ServerListEngine) Invoke(monitor Engine.SyncStatusMonitor, parentCtx context.Context) {
+func (se *ServerListEngine) Invoke(monitor *Engine.SyncStatusMonitor, parentCtx context.Context) {
 	ctx, cancel := context.WithCancelCause(parentCtx)
 	se.ctx = ctx
 	se.ctxCancel = cancel
@@ -86,15 +87,15 @@ func (se *ServerListEngine) Invoke(monitor Engine.SyncStatusMonitor, parentCtx c
 	se.queryEngine.SetMonitor(monitor)
 
 	go func() {
-		log.Println("Invoke " + se.params.ServerAddress)
+		se.Logger().Info("Fetching server list", "master", se.params.ServerAddress)
 
 		conn, dialErr := net.DialTimeout("tcp", se.params.ServerAddress, 15*time.Second)
 
 		if dialErr != nil {
-			log.Println("Dial failed:", dialErr.Error())
+			se.Logger().Error("Master server dial failed", "master", se.params.ServerAddress, "error", dialErr)
 			se.gotFatalError = true
-			se.monitor.EndServerListEngine(se)
 			se.ctxCancel(dialErr)
+			se.monitor.EndServerListEngine(se, dialErr)
 			return
 		}
 		se.connection = conn.(*net.TCPConn)
@@ -108,7 +109,7 @@ func (se *ServerListEngine) Invoke(monitor Engine.SyncStatusMonitor, parentCtx c
 	go func() {
 		select {
 		case <-se.ctx.Done():
-			se.monitor.EndServerListEngine(se)
+			se.monitor.EndServerListEngine(se, context.Cause(se.ctx))
 			se.Shutdown()
 			return
 		}
@@ -127,7 +128,7 @@ func (se *ServerListEngine) waitForDataOfLen(len int) []byte {
 		}
 		len, err := se.connection.Read(dataBuffer[totalRead : totalRead+remaining])
 		if err != nil {
-			log.Printf("SBV2 Read error %s\n", err.Error())
+			se.Logger().Error("Read error", "error", err)
 			se.gotFatalError = true
 			se.ctxCancel(err)
 			break
@@ -239,7 +240,7 @@ func (se *ServerListEngine) readListResponse() {
 		return
 	}
 	if numPopularBuff[0] != 0 {
-		log.Printf("SBV2 Got unsupported popular values of size %d", numPopularBuff[0])
+		se.Logger().Error("Got unsupported popular values", "size", numPopularBuff[0])
 		se.ctxCancel(errors.New("SBV2 Got unsupported popular values"))
 		se.gotFatalError = true
 		return
@@ -303,7 +304,8 @@ func (se *ServerListEngine) readListResponse() {
 				case KEYTYPE_STRING:
 					stringIndexBuff := se.waitForDataOfLen(1)
 					if stringIndexBuff[0] != 0xff {
-						log.Printf("SBV2 Unhandled string index %d", stringIndexBuff[0])
+						se.Logger().Error("Unhandled string index", "index", stringIndexBuff[0])
+						se.ctxCancel(errors.New("SBV2 Unhandled string index"))
 						return
 					} else {
 						se.ReadNTS() //skip string
@@ -336,9 +338,7 @@ func (se *ServerListEngine) readListResponse() {
 		}
 
 		var serverAddr netip.AddrPort = netip.AddrPortFrom(publicIp, port)
-		if se.monitor.BeginQuery(se, se.queryEngine, serverAddr) {
-			se.queryEngine.Query(serverAddr)
-		}
+		se.monitor.BeginQuery(se, se.queryEngine, serverAddr)
 	}
 
 }
@@ -392,21 +392,21 @@ func (se *ServerListEngine) writeListRequest() {
 
 	_, err := se.connection.Write(sendBuffer[0:currentIndex])
 	if err != nil {
-		log.Println("Failed to write SBV2 Auth Query:", err.Error())
-		se.monitor.EndServerListEngine(se)
+		se.Logger().Error("Failed to write list request", "error", err)
 		se.ctxCancel(err)
+		se.monitor.EndServerListEngine(se, err)
 		return
 	}
 
 	se.waitForCryptHeader()
 	if se.gotFatalError {
-		se.monitor.EndServerListEngine(se)
+		se.monitor.EndServerListEngine(se, context.Cause(se.ctx))
 		return
 	}
 
 	se.readListResponse()
 	if se.gotFatalError {
-		se.monitor.EndServerListEngine(se)
+		se.monitor.EndServerListEngine(se, context.Cause(se.ctx))
 		return
 	}
 
@@ -415,6 +415,7 @@ func (se *ServerListEngine) writeListRequest() {
 func (se *ServerListEngine) think() {
 
 	defer se.connection.Close()
+	defer se.freeEnctypeX() //free on the reading goroutine, Shutdown can run concurrently from the context watcher
 
 	se.writeListRequest()
 
@@ -424,6 +425,9 @@ func (se *ServerListEngine) Shutdown() {
 	if se.connection != nil {
 		se.connection.Close()
 	}
+}
+
+func (se *ServerListEngine) freeEnctypeX() {
 	if se.enctypeXReady {
 		se.enctypeXReady = false
 		C.free(se.enctypeXData)
@@ -0,0 +1,21 @@
+package Engines
+
+import "os-serverlist-sync/Engine"
+
+func init() {
+	Engine.RegisterServerListEngine("file",
+		func() interface{} { return new(TextFileServerListEngineParams) },
+		func() Engine.IServerListEngine { return &TextFileServerListEngine{} })
+
+	Engine.RegisterOutputHandler("file",
+		func() interface{} { return new(FileOutputHandlerParams) },
+		func() Engine.IQueryOutputHandler { return &FileOutputHandler{} })
+
+	Engine.RegisterOutputHandler("stdout",
+		func() interface{} { return new(StdoutOutputHandlerParams) },
+		func() Engine.IQueryOutputHandler { return &StdoutOutputHandler{} })
+
+	Engine.RegisterOutputHandler("webhook",
+		func() interface{} { return new(WebhookOutputHandlerParams) },
+		func() Engine.IQueryOutputHandler { return &WebhookOutputHandler{} })
+}
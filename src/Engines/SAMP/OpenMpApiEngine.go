@@ -11,14 +11,16 @@ import (
 )
 
 type OpenMpApiEngineParams struct {
-	Url string
+	Url string `validate:"required,url"`
 }
 
 type OpenMpApiEngine struct {
+	Engine.LogContext
+
 	queryEngine Engine.IQueryEngine
 	params      *OpenMpApiEngineParams
 
-	monitor   Engine.SyncStatusMonitor
+	monitor   *Engine.SyncStatusMonitor
 	ctx       context.Context
 	ctxCancel context.CancelCauseFunc
 }
@@ -35,7 +37,7 @@ type ServerEntry struct {
 	IP string `json:"ip"`
 }
 
-func (se *OpenMpApiEngine) Invoke(monitor Engine.SyncStatusMonitor, parentCtx context.Context) {
+func (se *OpenMpApiEngine) Invoke(monitor *Engine.SyncStatusMonitor, parentCtx context.Context) {
 	ctx, cancel := context.WithCancelCause(parentCtx)
 	se.ctx = ctx
 	se.ctxCancel = cancel
@@ -50,7 +52,7 @@ func (se *OpenMpApiEngine) Invoke(monitor Engine.SyncStatusMonitor, parentCtx co
 	go func() {
 		req, err := http.NewRequest("GET", se.params.Url, nil)
 		if err != nil {
-			fmt.Println("Got HTTP error", err)
+			se.Logger().Error("HTTP request failed", "url", se.params.Url, "error", err)
 			se.ctxCancel(err)
 			return
 		}
@@ -59,11 +61,20 @@ func (se *OpenMpApiEngine) Invoke(monitor Engine.SyncStatusMonitor, parentCtx co
 
 		res, err := client.Do(req)
 		if err != nil {
-			fmt.Println("Got HTTP error", err)
+			se.Logger().Error("HTTP request failed", "url", se.params.Url, "error", err)
 			se.ctxCancel(err)
 			return
 		}
 
+		defer res.Body.Close()
+
+		if res.StatusCode != http.StatusOK {
+			var statusErr = fmt.Errorf("unexpected HTTP status: %s", res.Status)
+			se.Logger().Error("HTTP request failed", "url", se.params.Url, "error", statusErr)
+			se.ctxCancel(statusErr)
+			return
+		}
+
 		data, err := io.ReadAll(res.Body)
 		if err != nil {
 			se.ctxCancel(err)
@@ -71,7 +82,11 @@ func (se *OpenMpApiEngine) Invoke(monitor Engine.SyncStatusMonitor, parentCtx co
 		}
 
 		var params []ServerEntry
-		json.Unmarshal(data, &params)
+		if err := json.Unmarshal(data, &params); err != nil {
+			se.Logger().Error("Failed to parse server list", "url", se.params.Url, "error", err)
+			se.ctxCancel(err)
+			return
+		}
 
 		for _, entry := range params {
 			var addrPort netip.AddrPort
@@ -79,9 +94,7 @@ func (se *OpenMpApiEngine) Invoke(monitor Engine.SyncStatusMonitor, parentCtx co
 			if addrErr != nil {
 				continue
 			}
-			if monitor.BeginQuery(se, se.queryEngine, addrPort) {
-				se.queryEngine.Query(addrPort)
-			}
+			monitor.BeginQuery(se, se.queryEngine, addrPort)
 		}
 
 		se.ctxCancel(nil)
@@ -90,7 +103,7 @@ func (se *OpenMpApiEngine) Invoke(monitor Engine.SyncStatusMonitor, parentCtx co
 	go func() {
 		select {
 		case <-se.ctx.Done():
-			se.monitor.EndServerListEngine(se)
+			se.monitor.EndServerListEngine(se, context.Cause(se.ctx))
 			se.Shutdown()
 			return
 		}
@@ -0,0 +1,13 @@
+package SAMP
+
+import "os-serverlist-sync/Engine"
+
+func init() {
+	Engine.RegisterServerListEngine("openmp_api",
+		func() interface{} { return new(OpenMpApiEngineParams) },
+		func() Engine.IServerListEngine { return &OpenMpApiEngine{} })
+
+	Engine.RegisterQueryEngine("samp",
+		func() interface{} { return new(QueryEngineParams) },
+		func() Engine.IQueryEngine { return &QueryEngine{} })
+}
@@ -1,44 +1,51 @@
 package SAMP
 
 import (
+	"context"
 	"encoding/binary"
-	"log"
 	"net"
 	"net/netip"
-	"os"
 	"os-serverlist-sync/Engine"
 	"strconv"
+	"sync/atomic"
+	"time"
 )
 
 type QueryEngineParams struct {
-	SourcePort uint16 `json:"source_port"`
+	Engine.UDPSocketParams
 }
 
+const (
+	SAMP_QUERY_INFO    byte = 'i'
+	SAMP_QUERY_RULES   byte = 'r'
+	SAMP_QUERY_PLAYERS byte = 'c' //names and scores, servers with more than 100 players don't answer it
+)
+
+// Sent as separate packets for each query
+var queryOpcodes = []byte{SAMP_QUERY_INFO, SAMP_QUERY_RULES, SAMP_QUERY_PLAYERS}
+
 type QueryEngine struct {
+	Engine.LogContext
+
 	params        *QueryEngineParams
-	connection    *net.UDPConn
+	socket        *Engine.UDPSocket
 	outputHandler Engine.IQueryOutputHandler
-	monitor       Engine.SyncStatusMonitor
+	monitor       atomic.Pointer[Engine.SyncStatusMonitor]
+	bindError     error
+	responses     *Engine.ServerInfoAssembler
 }
 
 func (qe *QueryEngine) SetParams(params interface{}) {
 	qe.params = params.(*QueryEngineParams)
+	qe.responses = Engine.NewServerInfoAssembler("samp", isComplete, qe.writeServerInfo)
 
-	addr := net.UDPAddr{
-		Port: int(qe.params.SourcePort),
-		IP:   net.ParseIP("0.0.0.0"),
-	}
-	ser, err := net.ListenUDP("udp", &addr)
+	socket, err := Engine.OpenUDPSocket(qe.params.UDPSocketParams, qe)
 	if err != nil {
-		log.Println("SAMP QueryEngine bind failed:", err.Error())
-		os.Exit(1)
+		qe.Logger().Error("Query engine bind failed", "source_port", qe.params.SourcePort, "error", err)
+		qe.bindError = err
+		return
 	}
-
-	qe.connection = ser
-
-	go func() {
-		qe.listen()
-	}()
+	qe.socket = socket
 }
 
 func (qe *QueryEngine) SetOutputHandler(handler Engine.IQueryOutputHandler) {
@@ -46,94 +53,230 @@ func (qe *QueryEngine) SetOutputHandler(handler Engine.IQueryOutputHandler) {
 }
 
 func (qe *QueryEngine) Query(destination netip.AddrPort) {
-	var addr = net.UDPAddrFromAddrPort(destination)
-	log.Printf("Send query to: %s\n", addr.String())
+	if qe.socket == nil {
+		return
+	}
+	qe.Logger().Debug("Send query", "server", destination.String())
+	for _, opcode := range queryOpcodes {
+		qe.socket.WriteTo(getQueryPacket(destination, opcode), destination)
+	}
+}
+
+func (qe *QueryEngine) PacketsPerQuery() int {
+	return len(queryOpcodes)
+}
+
+func getQueryPacket(destination netip.AddrPort, opcode byte) []byte {
 	writeBuffer := make([]byte, 11)
 	writeBuffer[0] = 0x53
 	writeBuffer[1] = 0x41
 	writeBuffer[2] = 0x4D
 	writeBuffer[3] = 0x50
 
-	var ipv4_addr = destination.Addr().As4()
+	//the header only has room for an IPv4 address, leave it zeroed for IPv6 servers
+	if Engine.NormalizeAddr(destination.Addr()).Is4() {
+		var ipv4_addr = Engine.NormalizeAddr(destination.Addr()).As4()
 
-	writeBuffer[4] = ipv4_addr[0]
-	writeBuffer[5] = ipv4_addr[1]
-	writeBuffer[6] = ipv4_addr[2]
-	writeBuffer[7] = ipv4_addr[3]
+		writeBuffer[4] = ipv4_addr[0]
+		writeBuffer[5] = ipv4_addr[1]
+		writeBuffer[6] = ipv4_addr[2]
+		writeBuffer[7] = ipv4_addr[3]
+	}
 
 	binary.LittleEndian.PutUint16(writeBuffer[8:10], uint16(destination.Port()))
 
-	writeBuffer[10] = 'i'
+	writeBuffer[10] = opcode
+	return writeBuffer
+}
 
-	qe.connection.WriteToUDP(writeBuffer, addr)
+// Responses echo the SAMP header of their query
+func (qe *QueryEngine) MatchesPacket(packet []byte) bool {
+	return len(packet) >= 11 && string(packet[0:4]) == "SAMP" &&
+		(packet[10] == SAMP_QUERY_INFO || packet[10] == SAMP_QUERY_RULES || packet[10] == SAMP_QUERY_PLAYERS)
 }
 
-func (qe *QueryEngine) listen() {
-	defer qe.connection.Close()
+func (qe *QueryEngine) HandlePacket(udpAddr *net.UDPAddr, buf []byte) {
+	if len(buf) < 11 {
+		return
+	}
+	if buf[0] != 0x53 || buf[1] != 0x41 || buf[2] != 0x4D || buf[3] != 0x50 {
+		return
+	}
+
+	switch buf[10] {
+	case SAMP_QUERY_INFO:
+		qe.handleInfo(udpAddr, buf)
+	case SAMP_QUERY_RULES:
+		qe.handleRules(udpAddr, buf)
+	case SAMP_QUERY_PLAYERS:
+		qe.handlePlayers(udpAddr, buf)
+	}
+}
+
+func (qe *QueryEngine) handleInfo(udpAddr *net.UDPAddr, buf []byte) {
+	propMap := make(map[string]string)
+	propMap["hostport"] = strconv.Itoa(udpAddr.Port)
+
+	//a password flag, player counts, then the hostname, gamemode and language with a 4 byte length before each
+	var numPlayers, maxPlayers uint16
+	var hostname, gamemode, language string
+	password, offset, ok := readUint8(buf, 11)
+	if ok {
+		numPlayers, offset, ok = readUint16(buf, offset)
+	}
+	if ok {
+		maxPlayers, offset, ok = readUint16(buf, offset)
+	}
+	if ok {
+		hostname, offset, ok = readLongString(buf, offset)
+	}
+	if ok {
+		gamemode, offset, ok = readLongString(buf, offset)
+	}
+	if ok {
+		language, _, ok = readLongString(buf, offset)
+	}
+	if !ok {
+		qe.Logger().Debug("Truncated info response", "server", udpAddr.String(), "length", len(buf))
+		return
+	}
+
+	if password == 0 {
+		propMap["password"] = "0"
+	} else {
+		propMap["password"] = "1"
+	}
+	propMap["numplayers"] = strconv.Itoa(int(numPlayers))
+	propMap["maxplayers"] = strconv.Itoa(int(maxPlayers))
+	propMap["hostname"] = hostname
+	propMap["gamemode"] = gamemode
+	propMap["gamevariant"] = language
+
+	var rtt time.Duration
+	if monitor := qe.monitor.Load(); monitor != nil {
+		rtt, _ = monitor.GetQueryRTT(qe, udpAddr.AddrPort())
+	}
+	qe.responses.Add(udpAddr.AddrPort(), "info", func(info *Engine.ServerInfo) {
+		info.Keys = propMap
+		info.RTT = rtt
+	})
+}
 
-	buf := make([]byte, 1492)
-	for {
-		len, addr, err := qe.connection.ReadFrom(buf)
-		if err != nil {
-			log.Println("SAMP Recvfrom failed:", err.Error())
+// A rule count, then each rule's name and value with a byte length before each
+func (qe *QueryEngine) handleRules(udpAddr *net.UDPAddr, buf []byte) {
+	var rules = make(map[string]string)
+	count, offset, ok := readUint16(buf, 11)
+	for i := 0; ok && i < int(count); i++ {
+		var name, value string
+		if name, offset, ok = readString(buf, offset); !ok {
 			break
 		}
+		if value, offset, ok = readString(buf, offset); !ok {
+			break
+		}
+		rules[name] = value
+	}
+
+	qe.responses.Add(udpAddr.AddrPort(), "rules", func(info *Engine.ServerInfo) {
+		info.Rules = rules
+	})
+}
 
-		if len < 11 {
-			continue
+// A player count, then each player's name with a byte length before it and their score
+func (qe *QueryEngine) handlePlayers(udpAddr *net.UDPAddr, buf []byte) {
+	var players []Engine.PlayerInfo
+	count, offset, ok := readUint16(buf, 11)
+	for i := 0; ok && i < int(count); i++ {
+		var name string
+		if name, offset, ok = readString(buf, offset); !ok || offset+4 > len(buf) {
+			break
 		}
+		var score = int32(binary.LittleEndian.Uint32(buf[offset:]))
+		offset += 4
+
+		var player = Engine.NewPlayerInfo()
+		player.SetKey("player_", name)
+		player.SetKey("score_", strconv.Itoa(int(score)))
+		players = append(players, *player)
+	}
+
+	qe.responses.Add(udpAddr.AddrPort(), "players", func(info *Engine.ServerInfo) {
+		info.Players = players
+	})
+}
+
+func readUint16(buf []byte, offset int) (uint16, int, bool) {
+	if offset+2 > len(buf) {
+		return 0, offset, false
+	}
+	return binary.LittleEndian.Uint16(buf[offset:]), offset + 2, true
+}
+
+func readUint8(buf []byte, offset int) (uint8, int, bool) {
+	if offset >= len(buf) {
+		return 0, offset, false
+	}
+	return buf[offset], offset + 1, true
+}
 
-		if qe.outputHandler != nil {
-			propMap := make(map[string]string)
-
-			if buf[0] != 0x53 || buf[1] != 0x41 || buf[2] != 0x4D || buf[3] != 0x50 {
-				continue
-			}
-
-			var udpAddr *net.UDPAddr = addr.(*net.UDPAddr)
-			propMap["hostport"] = strconv.Itoa(udpAddr.Port)
-
-			var offset = 11
-			if buf[offset] == 0 {
-				propMap["password"] = "0"
-			} else {
-				propMap["password"] = "1"
-			}
-			offset += 1
-
-			var players = binary.LittleEndian.Uint16(buf[offset:])
-			propMap["numplayers"] = strconv.Itoa(int(players))
-			offset += 2
-
-			players = binary.LittleEndian.Uint16(buf[offset:])
-			propMap["maxplayers"] = strconv.Itoa(int(players))
-			offset += 2
-
-			var hostname_len = int(binary.LittleEndian.Uint32(buf[offset:]))
-			offset += 4
-			propMap["hostname"] = string(buf[offset : offset+hostname_len])
-			offset += int(hostname_len)
-
-			var gamemode_len = int(binary.LittleEndian.Uint32(buf[offset:]))
-			offset += 4
-			propMap["gamemode"] = string(buf[offset : offset+gamemode_len])
-			offset += int(gamemode_len)
-
-			var language_len = int(binary.LittleEndian.Uint32(buf[offset:]))
-			offset += 4
-			propMap["gamevariant"] = string(buf[offset : offset+language_len])
-			offset += int(language_len)
-
-			qe.outputHandler.OnServerInfoResponse(addr, propMap)
-			qe.monitor.CompleteQuery(qe, udpAddr.AddrPort())
+// Reads a string with a byte length before it, false if it runs off the end of the packet
+func readString(buf []byte, offset int) (string, int, bool) {
+	if offset >= len(buf) {
+		return "", offset, false
+	}
+	var length = int(buf[offset])
+	offset++
+	if offset+length > len(buf) {
+		return "", offset, false
+	}
+	return string(buf[offset : offset+length]), offset + length, true
+}
+
+// Reads a string with a 4 byte length before it, false if it runs off the end of the packet
+func readLongString(buf []byte, offset int) (string, int, bool) {
+	if offset+4 > len(buf) {
+		return "", offset, false
+	}
+	var length = binary.LittleEndian.Uint32(buf[offset:])
+	offset += 4
+	if uint64(offset)+uint64(length) > uint64(len(buf)) {
+		return "", offset, false
+	}
+	return string(buf[offset : offset+int(length)]), offset + int(length), true
+}
+
+func isComplete(info *Engine.ServerInfo, received map[string]bool) bool {
+	return received["info"] && received["rules"] && received["players"]
+}
+
+func (qe *QueryEngine) writeServerInfo(address netip.AddrPort, info *Engine.ServerInfo) {
+	var monitor = qe.monitor.Load()
+	if monitor != nil {
+		if _, pending := monitor.GetQueryRTT(qe, address); !pending { //a late response to a completed or abandoned query
+			return
 		}
 	}
+	if qe.outputHandler != nil {
+		Engine.WriteServerInfo(qe.outputHandler, net.UDPAddrFromAddrPort(address), info)
+	}
+	if monitor != nil {
+		monitor.CompleteQuery(qe, address)
+	}
 }
 
 func (qe *QueryEngine) Shutdown() {
-	qe.connection.Close()
+	if qe.responses != nil {
+		qe.responses.Clear()
+	}
+	if qe.socket != nil {
+		qe.socket.Close()
+	}
+}
+
+func (qe *QueryEngine) CheckHealth(ctx context.Context) error {
+	return qe.bindError
 }
 
-func (qe *QueryEngine) SetMonitor(monitor Engine.SyncStatusMonitor) {
-	qe.monitor = monitor
+func (qe *QueryEngine) SetMonitor(monitor *Engine.SyncStatusMonitor) {
+	qe.monitor.Store(monitor)
 }
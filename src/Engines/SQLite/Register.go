@@ -0,0 +1,9 @@
+package SQLite
+
+import "os-serverlist-sync/Engine"
+
+func init() {
+	Engine.RegisterOutputHandler("sqlite",
+		func() interface{} { return new(SQLiteOutputHandlerParams) },
+		func() Engine.IQueryOutputHandler { return &SQLiteOutputHandler{} })
+}
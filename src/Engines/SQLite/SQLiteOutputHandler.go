@@ -0,0 +1,183 @@
+package SQLite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net"
+	"net/url"
+	"os-serverlist-sync/Engine"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type SQLiteOutputHandlerParams struct {
+	Path     string `json:"path" validate:"required"`
+	Gamename string `json:"gamename"`
+}
+
+const (
+	SQLITE_BUSY_TIMEOUT_MS int    = 5000 //pipelines sharing a database file wait for each other's writes
+	SQLITE_TIME_FORMAT     string = "2006-01-02T15:04:05.000Z"
+)
+
+// Created on open, existing databases are left as they are
+var sqliteSchema = []string{
+	`CREATE TABLE IF NOT EXISTS servers (
+		gamename TEXT NOT NULL,
+		address TEXT NOT NULL,
+		first_seen TEXT NOT NULL,
+		last_seen TEXT NOT NULL,
+		properties TEXT NOT NULL,
+		PRIMARY KEY (gamename, address)
+	)`,
+	`CREATE TABLE IF NOT EXISTS observations (
+		id INTEGER PRIMARY KEY,
+		timestamp TEXT NOT NULL,
+		gamename TEXT NOT NULL,
+		address TEXT NOT NULL,
+		numplayers INTEGER,
+		maxplayers INTEGER,
+		mapname TEXT
+	)`,
+	`CREATE INDEX IF NOT EXISTS observations_server ON observations (gamename, address, timestamp)`,
+}
+
+/*
+Keeps server history in a SQLite database. Each response upserts the server's row in servers, with the
+properties it last reported as a JSON object, and adds a row to observations for player count graphs.
+Timestamps are UTC text, so they sort and compare as strings.
+*/
+type SQLiteOutputHandler struct {
+	Engine.LogContext
+
+	params    *SQLiteOutputHandlerParams
+	db        *sql.DB
+	openError error
+
+	outputWrites atomic.Uint64
+	outputErrors atomic.Uint64
+}
+
+func (oh *SQLiteOutputHandler) SetParams(params interface{}) {
+	oh.params = params.(*SQLiteOutputHandlerParams)
+
+	db, err := openDatabase(oh.params.Path)
+	if err != nil {
+		oh.Logger().Error("Failed to open database", "path", oh.params.Path, "error", err)
+		oh.openError = err
+		return
+	}
+	oh.db = db
+}
+
+func openDatabase(path string) (*sql.DB, error) {
+	var options = url.Values{}
+	options.Set("_busy_timeout", strconv.Itoa(SQLITE_BUSY_TIMEOUT_MS))
+	options.Set("_journal_mode", "WAL")
+	options.Set("_synchronous", "NORMAL")
+
+	db, err := sql.Open("sqlite3", "file:"+path+"?"+options.Encode())
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1) //only written from one goroutine
+
+	for _, statement := range sqliteSchema {
+		if _, err := db.Exec(statement); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+func (oh *SQLiteOutputHandler) OnServerInfoResponse(sourceAddress net.Addr, serverProperties map[string]string) {
+	if oh.db == nil {
+		oh.outputErrors.Add(1)
+		return
+	}
+
+	var address = sourceAddress.String()
+	if udpAddr, ok := sourceAddress.(*net.UDPAddr); ok {
+		address = Engine.NormalizeAddrPort(udpAddr.AddrPort()).String()
+	}
+
+	if err := oh.writeServer(address, serverProperties); err != nil {
+		oh.Logger().Error("Failed to write server", "server", address, "path", oh.params.Path, "error", err)
+		oh.outputErrors.Add(1)
+		return
+	}
+	oh.outputWrites.Add(1)
+}
+
+func (oh *SQLiteOutputHandler) writeServer(address string, serverProperties map[string]string) error {
+	var now = time.Now().UTC().Format(SQLITE_TIME_FORMAT)
+
+	properties, err := json.Marshal(serverProperties)
+	if err != nil {
+		return err
+	}
+
+	tx, err := oh.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO servers (gamename, address, first_seen, last_seen, properties) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (gamename, address) DO UPDATE SET last_seen = excluded.last_seen, properties = excluded.properties`,
+		oh.params.Gamename, address, now, now, string(properties))
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`INSERT INTO observations (timestamp, gamename, address, numplayers, maxplayers, mapname) VALUES (?, ?, ?, ?, ?, ?)`,
+		now, oh.params.Gamename, address,
+		getIntProperty(serverProperties, "numplayers"), getIntProperty(serverProperties, "maxplayers"),
+		getStringProperty(serverProperties, "mapname"))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// NULL when the server didn't report the key, or it isn't a number
+func getIntProperty(serverProperties map[string]string, key string) sql.NullInt64 {
+	value, err := strconv.ParseInt(serverProperties[key], 10, 64)
+	return sql.NullInt64{Int64: value, Valid: err == nil}
+}
+
+func getStringProperty(serverProperties map[string]string, key string) sql.NullString {
+	value, ok := serverProperties[key]
+	return sql.NullString{String: value, Valid: ok}
+}
+
+func (oh *SQLiteOutputHandler) Close() error {
+	if oh.db == nil {
+		return nil
+	}
+	return oh.db.Close()
+}
+
+func (oh *SQLiteOutputHandler) GetOutputStats() Engine.OutputStats {
+	return Engine.OutputStats{
+		Writes: oh.outputWrites.Load(),
+		Errors: oh.outputErrors.Load(),
+	}
+}
+
+func (oh *SQLiteOutputHandler) GetGamename() string {
+	return oh.params.Gamename
+}
+
+func (oh *SQLiteOutputHandler) CheckHealth(ctx context.Context) error {
+	if oh.db == nil {
+		return oh.openError
+	}
+	return oh.db.PingContext(ctx)
+}
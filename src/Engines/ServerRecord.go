@@ -0,0 +1,40 @@
+package Engines
+
+import (
+	"net"
+	"os-serverlist-sync/Engine"
+	"time"
+)
+
+// A server response as the file, webhook and stdout outputs write it. Rules aren't written, every protocol which has them also sends them as keys
+type serverRecord struct {
+	Time       time.Time           `json:"time"`
+	Gamename   string              `json:"gamename,omitempty"`
+	Address    string              `json:"address"`
+	Protocol   string              `json:"protocol,omitempty"`
+	RTTMs      float64             `json:"rtt_ms,omitempty"`
+	Properties map[string]string   `json:"properties"`
+	Players    []Engine.PlayerInfo `json:"players,omitempty"`
+	Teams      []Engine.TeamInfo   `json:"teams,omitempty"`
+}
+
+func newServerRecord(now time.Time, gamename string, sourceAddress net.Addr, info *Engine.ServerInfo) serverRecord {
+	return serverRecord{
+		Time:       now,
+		Gamename:   gamename,
+		Address:    getServerAddress(sourceAddress),
+		Protocol:   info.Protocol,
+		RTTMs:      float64(info.RTT.Microseconds()) / 1000,
+		Properties: info.Keys,
+		Players:    info.Players,
+		Teams:      info.Teams,
+	}
+}
+
+// The address written by output handlers
+func getServerAddress(sourceAddress net.Addr) string {
+	if udpAddr, ok := sourceAddress.(*net.UDPAddr); ok {
+		return Engine.NormalizeAddrPort(udpAddr.AddrPort()).String()
+	}
+	return sourceAddress.String()
+}
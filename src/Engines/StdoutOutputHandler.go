@@ -0,0 +1,135 @@
+package Engines
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os-serverlist-sync/Engine"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	STDOUT_FORMAT_TABLE string = "table"
+	STDOUT_FORMAT_JSON  string = "json" //one JSON object per line
+)
+
+type StdoutOutputHandlerParams struct {
+	Format   string `json:"format"`   //table (default) or json
+	Label    string `json:"label"`    //printed with each server, e.g. to tell pipelines apart
+	Gamename string `json:"gamename"` //optional, only used for logging
+}
+
+// Every handler writes to the same stdout, so whole responses are written under one lock
+var stdoutMutex sync.Mutex
+
+// Prints each server response instead of storing it, for trying out a config
+type StdoutOutputHandler struct {
+	Engine.LogContext
+
+	params *StdoutOutputHandlerParams
+	writer io.Writer
+
+	outputWrites atomic.Uint64
+	outputErrors atomic.Uint64
+}
+
+type stdoutServerResponse struct {
+	Label string `json:"label,omitempty"`
+	serverRecord
+}
+
+func (oh *StdoutOutputHandler) SetParams(params interface{}) {
+	oh.params = params.(*StdoutOutputHandlerParams)
+	oh.writer = os.Stdout
+}
+
+func (oh *StdoutOutputHandler) OnServerInfoResponse(sourceAddress net.Addr, serverProperties map[string]string) {
+	oh.OnServerInfo(sourceAddress, &Engine.ServerInfo{Keys: serverProperties})
+}
+
+func (oh *StdoutOutputHandler) OnServerInfo(sourceAddress net.Addr, info *Engine.ServerInfo) {
+	var record = newServerRecord(time.Now(), "", sourceAddress, info)
+	var address = record.Address
+
+	var output []byte
+	if oh.params.Format == STDOUT_FORMAT_JSON {
+		data, err := json.Marshal(stdoutServerResponse{oh.params.Label, record})
+		if err != nil {
+			oh.Logger().Error("Failed to encode server", "server", address, "error", err)
+			oh.outputErrors.Add(1)
+			return
+		}
+		output = append(data, '\n')
+	} else {
+		output = formatServerTable(oh.params.Label, address, info)
+	}
+
+	stdoutMutex.Lock()
+	_, err := oh.writer.Write(output)
+	stdoutMutex.Unlock()
+
+	if err != nil {
+		oh.Logger().Error("Failed to write server", "server", address, "error", err)
+		oh.outputErrors.Add(1)
+		return
+	}
+	oh.outputWrites.Add(1)
+}
+
+// The address on its own line, then the properties sorted by key and the players
+func formatServerTable(label string, address string, info *Engine.ServerInfo) []byte {
+	var serverProperties = info.Keys
+	var buffer bytes.Buffer
+	if len(label) > 0 {
+		fmt.Fprintf(&buffer, "[%s] ", label)
+	}
+	fmt.Fprintln(&buffer, address)
+
+	var keys []string
+	for key := range serverProperties {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var table = tabwriter.NewWriter(&buffer, 0, 0, 2, ' ', 0)
+	for _, key := range keys {
+		fmt.Fprintf(table, "    %s\t%s\n", key, serverProperties[key])
+	}
+	table.Flush()
+
+	if len(info.Players) > 0 {
+		fmt.Fprintln(&buffer, "    players")
+		table = tabwriter.NewWriter(&buffer, 0, 0, 2, ' ', 0)
+		for _, player := range info.Players {
+			fmt.Fprintf(table, "      %s\tscore %d\tping %d\tteam %d\n", player.Name, player.Score, player.Ping, player.Team)
+		}
+		table.Flush()
+	}
+	return buffer.Bytes()
+}
+
+func (oh *StdoutOutputHandler) GetOutputStats() Engine.OutputStats {
+	return Engine.OutputStats{
+		Writes: oh.outputWrites.Load(),
+		Errors: oh.outputErrors.Load(),
+	}
+}
+
+func (oh *StdoutOutputHandler) GetGamename() string {
+	return oh.params.Gamename
+}
+
+func (p *StdoutOutputHandlerParams) ValidateParams() []Engine.ParamError {
+	switch p.Format {
+	case "", STDOUT_FORMAT_TABLE, STDOUT_FORMAT_JSON:
+		return nil
+	}
+	return []Engine.ParamError{{Field: "format", Message: fmt.Sprintf("must be %s or %s", STDOUT_FORMAT_TABLE, STDOUT_FORMAT_JSON)}}
+}
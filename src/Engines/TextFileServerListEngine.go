@@ -3,24 +3,24 @@ package Engines
 import (
 	"bufio"
 	"context"
-	"log"
 	"net"
 	"net/netip"
 	"os"
 	"os-serverlist-sync/Engine"
 	"strconv"
-	"strings"
 )
 
 type TextFileServerListEngineParams struct {
-	FilePath string
+	FilePath string `validate:"required"`
 }
 
 type TextFileServerListEngine struct {
+	Engine.LogContext
+
 	queryEngine Engine.IQueryEngine
 	params      *TextFileServerListEngineParams
 
-	monitor   Engine.SyncStatusMonitor
+	monitor   *Engine.SyncStatusMonitor
 	ctx       context.Context
 	ctxCancel context.CancelCauseFunc
 }
@@ -33,23 +33,35 @@ func (se *TextFileServerListEngine) SetParams(params interface{}) {
 	se.params = params.(*TextFileServerListEngineParams)
 }
 
-func (se *TextFileServerListEngine) resolveAddr(host string) (net.IP, error) {
+func (se *TextFileServerListEngine) resolveAddr(host string) (netip.Addr, error) {
+	//IP literals (including IPv6) don't need a lookup
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return Engine.NormalizeAddr(addr), nil
+	}
+
 	var resolver net.Resolver
 
-	names, err := resolver.LookupIP(se.ctx, "ip4", host)
+	names, err := resolver.LookupNetIP(se.ctx, "ip", host)
 
 	if err != nil {
-		return nil, err
+		return netip.Addr{}, err
 	}
 
 	if len(names) < 1 {
-		return nil, nil
+		return netip.Addr{}, nil
 	}
-	return names[0], nil
+
+	//prefer IPv4 where a host has both, as not every query engine's servers will listen on IPv6
+	for _, name := range names {
+		if Engine.NormalizeAddr(name).Is4() {
+			return Engine.NormalizeAddr(name), nil
+		}
+	}
+	return Engine.NormalizeAddr(names[0]), nil
 
 }
 
-func (se *TextFileServerListEngine) Invoke(monitor Engine.SyncStatusMonitor, parentCtx context.Context) {
+func (se *TextFileServerListEngine) Invoke(monitor *Engine.SyncStatusMonitor, parentCtx context.Context) {
 	ctx, cancel := context.WithCancelCause(parentCtx)
 	se.ctx = ctx
 	se.ctxCancel = cancel
@@ -61,44 +73,38 @@ func (se *TextFileServerListEngine) Invoke(monitor Engine.SyncStatusMonitor, par
 	go func() {
 		file, err := os.Open(se.params.FilePath)
 		if err != nil {
-			log.Fatal(err)
+			se.Logger().Error("Failed to open server list file", "path", se.params.FilePath, "error", err)
 			se.ctxCancel(err)
+			return
 		}
 		defer file.Close()
 
 		scanner := bufio.NewScanner(file)
 		// optionally, resize scanner's capacity for lines over 64K, see next example
 		for scanner.Scan() {
-			log.Println(scanner.Text())
 			var input = scanner.Text()
-			var delim = strings.Index(input, ":")
-			if delim == -1 {
-				log.Printf("Missing port: %s\n", input)
+			host, portstr, splitErr := net.SplitHostPort(input) //IPv6 addresses must be bracketed, [::1]:27900
+			if splitErr != nil {
+				se.Logger().Warn("Missing port", "input", input)
 				continue
 			}
 
-			var host = input[0:delim]
-			var portstr = input[delim+1:]
 			resolvedAddr, dnsErr := se.resolveAddr(host)
-			if dnsErr != nil || resolvedAddr == nil {
-				log.Printf("failed to resolve: %s\n", host)
+			if dnsErr != nil || !resolvedAddr.IsValid() {
+				se.Logger().Warn("Failed to resolve", "host", host, "error", dnsErr)
 				continue
 			}
 
 			port, _ := strconv.Atoi(portstr)
 
-			var ipAddr = netip.AddrFrom4([4]byte(resolvedAddr.To4()))
+			var addr = netip.AddrPortFrom(resolvedAddr, uint16(port))
 
-			var addr = netip.AddrPortFrom(ipAddr, uint16(port))
-
-			if monitor.BeginQuery(se, se.queryEngine, addr) {
-				se.queryEngine.Query(addr)
-			}
+			monitor.BeginQuery(se, se.queryEngine, addr)
 		}
 
 		if err := scanner.Err(); err != nil {
+			se.Logger().Error("Failed to read server list file", "path", se.params.FilePath, "error", err)
 			se.ctxCancel(err)
-			log.Fatal(err)
 		} else {
 			se.ctxCancel(nil)
 		}
@@ -107,7 +113,7 @@ func (se *TextFileServerListEngine) Invoke(monitor Engine.SyncStatusMonitor, par
 	go func() {
 		select {
 		case <-se.ctx.Done():
-			se.monitor.EndServerListEngine(se)
+			se.monitor.EndServerListEngine(se, context.Cause(se.ctx))
 			se.Shutdown()
 			return
 		}
@@ -0,0 +1,13 @@
+package UT2K
+
+import "os-serverlist-sync/Engine"
+
+func init() {
+	Engine.RegisterServerListEngine("ut2k",
+		func() interface{} { return new(UTMSServerListEngineParams) },
+		func() Engine.IServerListEngine { return &UTMSServerListEngine{} })
+
+	Engine.RegisterQueryEngine("ut2k",
+		func() interface{} { return new(QueryEngineParams) },
+		func() Engine.IQueryEngine { return &QueryEngine{} })
+}
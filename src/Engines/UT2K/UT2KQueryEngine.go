@@ -1,18 +1,19 @@
 package UT2K
 
 import (
+	"context"
 	"encoding/binary"
-	"log"
 	"net"
 	"net/netip"
-	"os"
 	"os-serverlist-sync/Engine"
 	"strconv"
+	"sync/atomic"
+	"time"
 )
 
 type QueryEngineParams struct {
-	SourcePort uint16 `json:"source_port"`
-	VersionID  int    `json:"versionid"`
+	Engine.UDPSocketParams
+	VersionID int `json:"versionid" validate:"required"`
 }
 
 // Since this is UDP, do not associate the state with the engine itself! only pass by args!
@@ -27,31 +28,41 @@ const (
 	UT2003_VERSION     = 121
 )
 
+const (
+	UT2K_QUERY_INFO    uint8 = 0x00
+	UT2K_QUERY_RULES   uint8 = 0x01
+	UT2K_QUERY_PLAYERS uint8 = 0x02
+
+	UT2004_RED_TEAM_BIT  uint32 = 0x20000000 //set in the stats ID of UT2004 players on the red team
+	UT2004_BLUE_TEAM_BIT uint32 = 0x40000000
+)
+
+// Sent as separate packets for each query
+var queryTypes = []uint8{UT2K_QUERY_INFO, UT2K_QUERY_RULES, UT2K_QUERY_PLAYERS}
+
 type QueryEngine struct {
+	Engine.LogContext
+
 	params        *QueryEngineParams
-	connection    *net.UDPConn
+	socket        *Engine.UDPSocket
 	outputHandler Engine.IQueryOutputHandler
-	monitor       Engine.SyncStatusMonitor
+	monitor       atomic.Pointer[Engine.SyncStatusMonitor]
+	bindError     error
+	responses     *Engine.ServerInfoAssembler
 }
 
 func (qe *QueryEngine) SetParams(params interface{}) {
 	qe.params = params.(*QueryEngineParams)
+	//rules may be split over several packets with nothing marking the last, so servers are only written once the assembler times out
+	qe.responses = Engine.NewServerInfoAssembler("ut2k", nil, qe.writeServerInfo)
 
-	addr := net.UDPAddr{
-		Port: int(qe.params.SourcePort),
-		IP:   net.ParseIP("0.0.0.0"),
-	}
-	ser, err := net.ListenUDP("udp", &addr)
+	socket, err := Engine.OpenUDPSocket(qe.params.UDPSocketParams, qe)
 	if err != nil {
-		log.Println("UT2K QueryEngine bind failed:", err.Error())
-		os.Exit(1)
+		qe.Logger().Error("Query engine bind failed", "source_port", qe.params.SourcePort, "error", err)
+		qe.bindError = err
+		return
 	}
-
-	qe.connection = ser
-
-	go func() {
-		qe.listen()
-	}()
+	qe.socket = socket
 }
 
 func (qe *QueryEngine) SetOutputHandler(handler Engine.IQueryOutputHandler) {
@@ -59,58 +70,67 @@ func (qe *QueryEngine) SetOutputHandler(handler Engine.IQueryOutputHandler) {
 }
 
 func (qe *QueryEngine) Query(destination netip.AddrPort) {
-	var addr = net.UDPAddrFromAddrPort(destination)
-
-	writeBuffer := make([]byte, 5)
-	binary.BigEndian.PutUint32(writeBuffer, uint32(qe.params.VersionID))
+	if qe.socket == nil {
+		return
+	}
 
-	writeBuffer[4] = 0x00 //basic info query
+	for _, queryType := range queryTypes {
+		writeBuffer := make([]byte, 5)
+		binary.BigEndian.PutUint32(writeBuffer, uint32(qe.params.VersionID))
+		writeBuffer[4] = queryType
 
-	qe.connection.WriteToUDP(writeBuffer, addr)
+		qe.socket.WriteTo(writeBuffer, destination)
+	}
 }
 
-func (qe *QueryEngine) listen() {
-	defer qe.connection.Close()
+func (qe *QueryEngine) PacketsPerQuery() int {
+	return len(queryTypes)
+}
 
-	buf := make([]byte, 1492)
-	for {
-		len, addr, err := qe.connection.ReadFrom(buf)
-		if err != nil {
-			log.Println("UT2K Query Recvfrom failed:", err.Error())
-			return
-		}
+// Responses start with the queried version and query type
+func (qe *QueryEngine) MatchesPacket(packet []byte) bool {
+	return len(packet) >= 5 && int(binary.LittleEndian.Uint32(packet)) == qe.params.VersionID && packet[4] <= UT2K_QUERY_PLAYERS
+}
 
-		buf[len] = 0
+func (qe *QueryEngine) HandlePacket(addr *net.UDPAddr, packet []byte) {
+	//copied with a terminating zero, so strings running off the end of the packet stop there
+	var buf = make([]byte, len(packet)+1)
+	copy(buf, packet)
 
-		var state = &QueryParserState{}
-		state.TotalLength = len
-		state.CurrentOffset = 0
-		state.Buffer = buf
+	var state = &QueryParserState{}
+	state.TotalLength = len(packet)
+	state.CurrentOffset = 0
+	state.Buffer = buf
 
-		if qe.outputHandler != nil {
-			qe.handleResponse(addr, state)
-		}
-	}
+	qe.handleResponse(addr, state)
 }
 
-func (qe *QueryEngine) handleResponse(sourceAddress net.Addr, state *QueryParserState) {
+func (qe *QueryEngine) handleResponse(sourceAddress *net.UDPAddr, state *QueryParserState) {
 	version := binary.LittleEndian.Uint32(state.Buffer[state.CurrentOffset:4])
 	state.CurrentOffset += 4
 
-	propMap := make(map[string]string)
-
 	if int(version) != qe.params.VersionID {
-		log.Printf("[%s] Unexpected version %d!\n", sourceAddress.String(), version)
+		qe.Logger().Warn("Unexpected version", "server", sourceAddress.String(), "version", version)
 		return
 	}
 
 	var queryType uint8 = state.Buffer[state.CurrentOffset]
 	state.CurrentOffset++
 
-	if queryType != 0 {
-		log.Printf("[%s] Unexpected query response type!\n", sourceAddress.String())
-		return
+	switch queryType {
+	case UT2K_QUERY_INFO:
+		qe.handleInfo(sourceAddress, state, int(version))
+	case UT2K_QUERY_RULES:
+		qe.handleRules(sourceAddress, state)
+	case UT2K_QUERY_PLAYERS:
+		qe.handlePlayers(sourceAddress, state, int(version))
+	default:
+		qe.Logger().Warn("Unexpected query response type", "server", sourceAddress.String(), "type", queryType)
 	}
+}
+
+func (qe *QueryEngine) handleInfo(sourceAddress *net.UDPAddr, state *QueryParserState, version int) {
+	propMap := make(map[string]string)
 
 	state.CurrentOffset += 4 //server id
 
@@ -141,7 +161,7 @@ func (qe *QueryEngine) handleResponse(sourceAddress net.Addr, state *QueryParser
 
 	state.CurrentOffset += 4
 
-	if int(version) == UT2004_VERSION {
+	if version == UT2004_VERSION {
 		state.CurrentOffset += 4
 
 		var skill = qe.readCompactString(state)
@@ -160,14 +180,89 @@ func (qe *QueryEngine) handleResponse(sourceAddress net.Addr, state *QueryParser
 	propMap["standard"] = "true"
 	propMap["nomutators"] = "false"
 
-	//fake the query port info (maybe we want to trust what is in this packet, but for now just -1 it)
-	var gamePortAddress = sourceAddress.(*net.UDPAddr)
-	gamePortAddress.Port = gamePortAddress.Port - 1
+	var rtt time.Duration
+	if monitor := qe.monitor.Load(); monitor != nil {
+		rtt, _ = monitor.GetQueryRTT(qe, sourceAddress.AddrPort())
+	}
+	qe.responses.Add(sourceAddress.AddrPort(), "info", func(info *Engine.ServerInfo) {
+		info.Keys = propMap
+		info.RTT = rtt
+	})
+}
+
+// Rules are name and value pairs until the end of the packet
+func (qe *QueryEngine) handleRules(sourceAddress *net.UDPAddr, state *QueryParserState) {
+	var rules = make(map[string]string)
+	for state.CurrentOffset < state.TotalLength {
+		var name = qe.readCompactString(state)
+		var value = qe.readCompactString(state)
+		if state.CurrentOffset > state.TotalLength { //ran off the end of the packet
+			break
+		}
+		rules[name] = value
+	}
+
+	qe.responses.Add(sourceAddress.AddrPort(), "rules", func(info *Engine.ServerInfo) {
+		if info.Rules == nil {
+			info.Rules = make(map[string]string)
+		}
+		for name, value := range rules { //servers with many rules split them over several packets
+			info.Rules[name] = value
+		}
+	})
+}
 
+// Each player is an id, name, ping, score and stats id until the end of the packet, large servers send several packets
+func (qe *QueryEngine) handlePlayers(sourceAddress *net.UDPAddr, state *QueryParserState, version int) {
+	var players []Engine.PlayerInfo
+	for state.CurrentOffset+4 <= state.TotalLength {
+		state.CurrentOffset += 4 //player id
+		var name = qe.readCompactString(state)
+		if state.CurrentOffset+12 > state.TotalLength {
+			break
+		}
+		var ping = binary.LittleEndian.Uint32(state.Buffer[state.CurrentOffset:])
+		var score = int32(binary.LittleEndian.Uint32(state.Buffer[state.CurrentOffset+4:]))
+		var statsID = binary.LittleEndian.Uint32(state.Buffer[state.CurrentOffset+8:])
+		state.CurrentOffset += 12
+
+		var player = Engine.NewPlayerInfo()
+		player.SetKey("player_", name)
+		player.SetKey("ping_", strconv.Itoa(int(ping)))
+		player.SetKey("score_", strconv.Itoa(int(score)))
+		if version == UT2004_VERSION {
+			if statsID&UT2004_RED_TEAM_BIT != 0 {
+				player.SetKey("team_", "0")
+			} else if statsID&UT2004_BLUE_TEAM_BIT != 0 {
+				player.SetKey("team_", "1")
+			}
+		}
+		players = append(players, *player)
+	}
+
+	qe.responses.Add(sourceAddress.AddrPort(), "players", func(info *Engine.ServerInfo) {
+		info.Players = append(info.Players, players...)
+	})
+}
+
+func (qe *QueryEngine) writeServerInfo(address netip.AddrPort, info *Engine.ServerInfo) {
+	var monitor = qe.monitor.Load()
+	if monitor != nil {
+		if _, pending := monitor.GetQueryRTT(qe, address); !pending { //a late response to a completed or abandoned query
+			return
+		}
+	}
 	if qe.outputHandler != nil {
-		qe.outputHandler.OnServerInfoResponse(gamePortAddress, propMap)
+		Engine.WriteServerInfo(qe.outputHandler, net.UDPAddrFromAddrPort(qe.GetOutputAddress(address)), info)
+	}
+	if monitor != nil {
+		monitor.CompleteQuery(qe, address)
 	}
-	qe.monitor.CompleteQuery(qe, sourceAddress.(*net.UDPAddr).AddrPort())
+}
+
+// Servers are written under their game port, faked as the query port - 1 (maybe we want to trust the port in the response)
+func (qe *QueryEngine) GetOutputAddress(address netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(address.Addr(), address.Port()-1)
 }
 
 func (qe *QueryEngine) readCompactInt(state *QueryParserState) int {
@@ -226,9 +321,18 @@ func (qe *QueryEngine) readCompactString(state *QueryParserState) string {
 }
 
 func (qe *QueryEngine) Shutdown() {
-	qe.connection.Close()
+	if qe.responses != nil {
+		qe.responses.Clear()
+	}
+	if qe.socket != nil {
+		qe.socket.Close()
+	}
+}
+
+func (qe *QueryEngine) CheckHealth(ctx context.Context) error {
+	return qe.bindError
 }
 
-func (qe *QueryEngine) SetMonitor(monitor Engine.SyncStatusMonitor) {
-	qe.monitor = monitor
+func (qe *QueryEngine) SetMonitor(monitor *Engine.SyncStatusMonitor) {
+	qe.monitor.Store(monitor)
 }
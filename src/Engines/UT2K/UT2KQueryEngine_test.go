@@ -0,0 +1,90 @@
+package UT2K
+
+import (
+	"encoding/binary"
+	"net"
+	"os-serverlist-sync/Engine"
+	"testing"
+	"time"
+)
+
+type fakeOutputHandler struct {
+	written chan *Engine.ServerInfo
+}
+
+func (h *fakeOutputHandler) OnServerInfoResponse(sourceAddress net.Addr, serverProperties map[string]string) {
+}
+
+func (h *fakeOutputHandler) OnServerInfo(sourceAddress net.Addr, info *Engine.ServerInfo) {
+	h.written <- info
+}
+
+func (h *fakeOutputHandler) SetParams(params interface{}) {
+}
+
+// Builds a response packet, uint32 fields are little endian and strings are written as compact strings
+func buildResponse(queryType uint8, fields ...interface{}) []byte {
+	var packet = binary.LittleEndian.AppendUint32(nil, uint32(UT2004_VERSION))
+	packet = append(packet, queryType)
+	for _, field := range fields {
+		switch value := field.(type) {
+		case uint32:
+			packet = binary.LittleEndian.AppendUint32(packet, value)
+		case string:
+			packet = append(packet, byte(len(value)+1))
+			packet = append(packet, value...)
+			packet = append(packet, 0x00)
+		}
+	}
+	return packet
+}
+
+func TestSplitRules(t *testing.T) {
+	var handler = &fakeOutputHandler{written: make(chan *Engine.ServerInfo, 2)}
+	var qe = &QueryEngine{params: &QueryEngineParams{VersionID: UT2004_VERSION}}
+	qe.responses = Engine.NewServerInfoAssembler("ut2k", nil, qe.writeServerInfo)
+	qe.SetOutputHandler(handler)
+
+	var address = &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 7778}
+	var packets = [][]byte{
+		buildResponse(UT2K_QUERY_INFO, uint32(1), "", uint32(7777), uint32(7778), "server", "DM-Rankin", "xDeathMatch", uint32(1), uint32(16), uint32(0), uint32(0), "Adept"),
+		buildResponse(UT2K_QUERY_RULES, "ServerMode", "dedicated", "AdminName", "admin"),
+		buildResponse(UT2K_QUERY_PLAYERS, uint32(1), "player", uint32(50), uint32(10), UT2004_RED_TEAM_BIT),
+		buildResponse(UT2K_QUERY_RULES, "MaxSpectators", "2"), //the rest of the rules, after the players
+	}
+	for _, packet := range packets {
+		if !qe.MatchesPacket(packet) {
+			t.Fatalf("packet %x not matched", packet)
+		}
+		qe.HandlePacket(address, packet)
+	}
+
+	var info *Engine.ServerInfo
+	select {
+	case info = <-handler.written:
+	case <-time.After(2 * Engine.SERVER_INFO_ASSEMBLY_TIMEOUT):
+		t.Fatal("server info not written")
+	}
+
+	if info.Keys["hostname"] != "server" || info.Keys["numplayers"] != "1" || info.Keys["botlevel"] != "Adept" {
+		t.Errorf("got keys %v", info.Keys)
+	}
+	var wantRules = map[string]string{"ServerMode": "dedicated", "AdminName": "admin", "MaxSpectators": "2"}
+	if len(info.Rules) != len(wantRules) {
+		t.Errorf("got rules %v, want %v", info.Rules, wantRules)
+	}
+	for name, value := range wantRules {
+		if info.Rules[name] != value {
+			t.Errorf("got rule %s = %q, want %q", name, info.Rules[name], value)
+		}
+	}
+	if len(info.Players) != 1 || info.Players[0].Keys["player_"] != "player" || info.Players[0].Keys["team_"] != "0" {
+		t.Errorf("got players %v", info.Players)
+	}
+
+	select {
+	case extra := <-handler.written:
+		t.Errorf("server written twice, second time with %v", extra)
+	case <-time.After(2 * Engine.SERVER_INFO_ASSEMBLY_TIMEOUT):
+	}
+}
@@ -5,7 +5,7 @@ import (
 	"crypto/md5"
 	"encoding/binary"
 	"encoding/hex"
-	"log"
+	"errors"
 	"net"
 	"net/netip"
 	"os-serverlist-sync/Engine"
@@ -13,10 +13,10 @@ import (
 )
 
 type UTMSServerListEngineParams struct {
-	ServerAddress string `json:"address"`
-	CdKey         string `json:"cdkey"`
+	ServerAddress string `json:"address" validate:"required,hostport"`
+	CdKey         string `json:"cdkey" validate:"required" secret:"true"`
 	ClientName    string `json:"client_name"`
-	ClientVersion int    `json:"client_version"`
+	ClientVersion int    `json:"client_version" validate:"required"`
 	RunningOs     int    `json:"running_os"`
 	Language      string `json:"language"`
 	GpuDeviceId   int    `json:"gpu_device_id"`
@@ -34,6 +34,8 @@ type UTMSParserState struct {
 }
 
 type UTMSServerListEngine struct {
+	Engine.LogContext
+
 	connection    *net.TCPConn
 	queryEngine   Engine.IQueryEngine
 	params        *UTMSServerListEngineParams
@@ -42,7 +44,7 @@ type UTMSServerListEngine struct {
 
 	challenge string
 
-	monitor Engine.SyncStatusMonitor
+	monitor *Engine.SyncStatusMonitor
 
 	ctx       context.Context
 	ctxCancel context.CancelCauseFunc
@@ -56,7 +58,7 @@ func (se *UTMSServerListEngine) SetParams(params interface{}) {
 	se.params = params.(*UTMSServerListEngineParams)
 }
 
-func (se *UTMSServerListEngine) Invoke(monitor Engine.SyncStatusMonitor, parentCtx context.Context) {
+func (se *UTMSServerListEngine) Invoke(monitor *Engine.SyncStatusMonitor, parentCtx context.Context) {
 	ctx, cancel := context.WithCancelCause(parentCtx)
 	se.ctx = ctx
 	se.ctxCancel = cancel
@@ -66,14 +68,14 @@ func (se *UTMSServerListEngine) Invoke(monitor Engine.SyncStatusMonitor, parentC
 	se.queryEngine.SetMonitor(monitor)
 
 	go func() {
-		log.Println("Invoke " + se.params.ServerAddress)
+		se.Logger().Info("Fetching server list", "master", se.params.ServerAddress)
 
 		conn, dialErr := net.DialTimeout("tcp", se.params.ServerAddress, 15*time.Second)
 
 		if dialErr != nil {
-			log.Println("Dial failed:", dialErr.Error())
-			se.monitor.EndServerListEngine(se)
+			se.Logger().Error("Master server dial failed", "master", se.params.ServerAddress, "error", dialErr)
 			se.ctxCancel(dialErr)
+			se.monitor.EndServerListEngine(se, dialErr)
 			return
 		}
 		se.connection = conn.(*net.TCPConn)
@@ -88,7 +90,7 @@ func (se *UTMSServerListEngine) Invoke(monitor Engine.SyncStatusMonitor, parentC
 	go func() {
 		select {
 		case <-se.ctx.Done():
-			se.monitor.EndServerListEngine(se)
+			se.monitor.EndServerListEngine(se, context.Cause(se.ctx))
 			se.Shutdown()
 			return
 		}
@@ -105,21 +107,21 @@ func (se *UTMSServerListEngine) readMessage() {
 	se.readValidation()
 
 	if se.gotFatalError {
-		log.Printf("Got fatal error from MS, aborting")
+		se.Logger().Error("Got fatal error from master server, aborting")
 		return
 	}
 
 	if se.params.ClientVersion >= 3000 {
 		se.readVerification()
 		if se.gotFatalError {
-			log.Printf("Got fatal error from MS, aborting")
+			se.Logger().Error("Got fatal error from master server, aborting")
 			return
 		}
 	}
 
 	se.sendListRequest()
 	if se.gotFatalError {
-		log.Printf("Got fatal error from MS, aborting")
+		se.Logger().Error("Got fatal error from master server, aborting")
 		return
 	}
 
@@ -176,9 +178,7 @@ func (se *UTMSServerListEngine) readListResponse() {
 		serverPort := binary.LittleEndian.Uint16(se.parser.Buffer[se.parser.CurrentOffset:])
 
 		var addr = netip.AddrPortFrom(serverIP, serverPort)
-		if se.monitor.BeginQuery(se, se.queryEngine, addr) {
-			se.queryEngine.Query(addr)
-		}
+		se.monitor.BeginQuery(se, se.queryEngine, addr)
 	}
 }
 
@@ -187,7 +187,7 @@ func (se *UTMSServerListEngine) waitForData() {
 
 	_, lenErr := se.connection.Read(lengthBuffer)
 	if lenErr != nil {
-		log.Println("Failed to read UTMS recv length", lenErr.Error())
+		se.Logger().Error("Failed to read message length", "error", lenErr)
 		se.gotFatalError = true
 		se.ctxCancel(lenErr)
 		return
@@ -207,7 +207,7 @@ func (se *UTMSServerListEngine) waitForData() {
 		}
 
 		if incErr != nil {
-			log.Println("Failed to read UTMS incoming buffer", incErr.Error())
+			se.Logger().Error("Failed to read message", "error", incErr)
 			se.gotFatalError = true
 			se.ctxCancel(incErr)
 			return
@@ -226,7 +226,7 @@ func (se *UTMSServerListEngine) readChallenge() {
 	se.waitForData()
 
 	if se.gotFatalError {
-		log.Printf("Got fatal error from MS, aborting")
+		se.Logger().Error("Got fatal error from master server, aborting")
 		return
 	}
 
@@ -244,6 +244,7 @@ func (se *UTMSServerListEngine) readVerification() {
 
 	if verified != "VERIFIED" {
 		se.gotFatalError = true
+		se.ctxCancel(errors.New("UTMS client not verified: " + verified))
 	}
 }
 
@@ -257,6 +258,7 @@ func (se *UTMSServerListEngine) readValidation() {
 
 	if status != "APPROVED" {
 		se.gotFatalError = true
+		se.ctxCancel(errors.New("UTMS client not approved: " + status))
 		return
 	}
 
@@ -357,7 +359,7 @@ func (se *UTMSServerListEngine) sendBuffer(buffer []byte) {
 
 	_, sendErr := se.connection.Write(writeBuffer)
 	if sendErr != nil {
-		log.Println("Failed to send buffer:", sendErr.Error())
+		se.Logger().Error("Failed to send message", "error", sendErr)
 		se.ctxCancel(sendErr)
 		return
 	}
@@ -0,0 +1,334 @@
+package Engines
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os-serverlist-sync/Engine"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type WebhookOutputHandlerParams struct {
+	URLs            []string            `json:"urls" validate:"required,url"`
+	Secret          string              `json:"secret" secret:"true"` //signs each request body with HMAC-SHA256 when set
+	Gamename        string              `json:"gamename"`
+	BatchSize       int                 `json:"batch_size" validate:"nonnegative"`        //servers per request
+	BatchIntervalMs int                 `json:"batch_interval_ms" validate:"nonnegative"` //longest a server waits for its batch to fill
+	QueueSize       int                 `json:"queue_size" validate:"nonnegative"`
+	TimeoutMs       int                 `json:"timeout_ms" validate:"nonnegative"` //per request
+	Retry           *Engine.RetryPolicy `json:"retry"`                             //initial_timeout_ms is the delay before the first retry
+}
+
+const (
+	WEBHOOK_BATCH_SIZE          int    = 100
+	WEBHOOK_BATCH_INTERVAL_MS   int    = 5000
+	WEBHOOK_QUEUE_SIZE          int    = 10000
+	WEBHOOK_TIMEOUT_MS          int    = 10000
+	WEBHOOK_ATTEMPTS            int    = 4
+	WEBHOOK_RETRY_DELAY_MS      int    = 1000
+	WEBHOOK_RETRY_MULTIPLIER           = 2.0
+	WEBHOOK_SIGNATURE_HEADER    string = "X-Signature-256"
+	WEBHOOK_RESPONSE_BODY_LIMIT int64  = 64 * 1024
+)
+
+// The JSON body of each request
+type webhookBatch struct {
+	SentAt   time.Time      `json:"sent_at"`
+	Gamename string         `json:"gamename,omitempty"`
+	Servers  []serverRecord `json:"servers"`
+}
+
+// A response status which may succeed if the request is sent again
+type webhookStatusError struct {
+	StatusCode int
+}
+
+func (e *webhookStatusError) Error() string {
+	return fmt.Sprintf("unexpected response status %d", e.StatusCode)
+}
+
+/*
+POSTs server responses as JSON batches to every configured URL. Responses are queued and sent from the
+handler's own goroutine once batch_size have been queued or the oldest has waited batch_interval_ms, so
+a slow endpoint only ever fills this handler's queue. When the queue is full responses are dropped.
+
+When a secret is set each request has a header with the HMAC-SHA256 of its body:
+
+	X-Signature-256: sha256=<hex digest>
+
+Network errors, 429 and 5xx responses are retried with backoff, a batch counts as written once every URL
+has accepted it.
+*/
+type WebhookOutputHandler struct {
+	Engine.LogContext
+
+	params      *WebhookOutputHandlerParams
+	retryPolicy Engine.RetryPolicy
+	client      *http.Client
+
+	queue  chan serverRecord
+	flush  chan struct{}
+	done   chan struct{}
+	mutex  sync.Mutex //guards closing queue
+	closed bool
+	full   atomic.Bool
+
+	context context.Context //cancelled when Close gives up waiting, stopping any request or retry in progress
+	cancel  context.CancelFunc
+
+	outputWrites atomic.Uint64
+	outputErrors atomic.Uint64
+}
+
+func (oh *WebhookOutputHandler) SetParams(params interface{}) {
+	oh.params = params.(*WebhookOutputHandlerParams)
+
+	oh.retryPolicy = Engine.RetryPolicy{
+		Attempts:          WEBHOOK_ATTEMPTS,
+		InitialTimeoutMs:  WEBHOOK_RETRY_DELAY_MS,
+		BackoffMultiplier: WEBHOOK_RETRY_MULTIPLIER,
+	}
+	if retry := oh.params.Retry; retry != nil { //fields which aren't set keep the webhook defaults
+		oh.retryPolicy.Attempts = getOrDefault(retry.Attempts, oh.retryPolicy.Attempts)
+		oh.retryPolicy.InitialTimeoutMs = getOrDefault(retry.InitialTimeoutMs, oh.retryPolicy.InitialTimeoutMs)
+		if retry.BackoffMultiplier >= 1.0 {
+			oh.retryPolicy.BackoffMultiplier = retry.BackoffMultiplier
+		}
+		oh.retryPolicy.JitterMs = retry.JitterMs
+		oh.retryPolicy.MaxTimeoutMs = retry.MaxTimeoutMs
+	}
+
+	oh.client = &http.Client{Timeout: time.Duration(getOrDefault(oh.params.TimeoutMs, WEBHOOK_TIMEOUT_MS)) * time.Millisecond}
+	oh.queue = make(chan serverRecord, getOrDefault(oh.params.QueueSize, WEBHOOK_QUEUE_SIZE))
+	oh.flush = make(chan struct{}, 1)
+	oh.done = make(chan struct{})
+	oh.context, oh.cancel = context.WithCancel(context.Background())
+
+	go oh.send()
+}
+
+func getOrDefault(value int, defaultValue int) int {
+	if value > 0 {
+		return value
+	}
+	return defaultValue
+}
+
+func (oh *WebhookOutputHandler) OnServerInfoResponse(sourceAddress net.Addr, serverProperties map[string]string) {
+	oh.OnServerInfo(sourceAddress, &Engine.ServerInfo{Keys: serverProperties})
+}
+
+func (oh *WebhookOutputHandler) OnServerInfo(sourceAddress net.Addr, info *Engine.ServerInfo) {
+	var record = newServerRecord(time.Now().UTC(), oh.params.Gamename, sourceAddress, info)
+
+	oh.mutex.Lock()
+	defer oh.mutex.Unlock()
+	if oh.closed {
+		oh.outputErrors.Add(1)
+		return
+	}
+
+	select {
+	case oh.queue <- record:
+		oh.full.Store(false)
+	default:
+		oh.outputErrors.Add(1)
+		if oh.full.CompareAndSwap(false, true) {
+			oh.Logger().Warn("Webhook queue full, dropping servers", "queue_size", cap(oh.queue))
+		}
+	}
+}
+
+func (oh *WebhookOutputHandler) send() {
+	defer close(oh.done)
+
+	var batchSize = getOrDefault(oh.params.BatchSize, WEBHOOK_BATCH_SIZE)
+	var batchInterval = time.Duration(getOrDefault(oh.params.BatchIntervalMs, WEBHOOK_BATCH_INTERVAL_MS)) * time.Millisecond
+
+	var batch []serverRecord
+	var timer = time.NewTimer(batchInterval)
+	stopTimer(timer)
+
+	var sendBatch = func() {
+		stopTimer(timer)
+		if len(batch) > 0 {
+			oh.sendBatch(batch)
+			batch = nil
+		}
+	}
+
+	for {
+		select {
+		case record, ok := <-oh.queue:
+			if !ok {
+				sendBatch()
+				return
+			}
+			batch = append(batch, record)
+			if len(batch) == 1 {
+				timer.Reset(batchInterval)
+			}
+			if len(batch) >= batchSize {
+				sendBatch()
+			}
+		case <-timer.C:
+			sendBatch()
+		case <-oh.flush:
+			sendBatch()
+		}
+	}
+}
+
+// Stops the timer, leaving its channel empty so a Reset doesn't see an old expiry
+func stopTimer(timer *time.Timer) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+}
+
+func (oh *WebhookOutputHandler) sendBatch(batch []serverRecord) {
+	body, err := json.Marshal(webhookBatch{time.Now().UTC(), oh.params.Gamename, batch})
+	if err != nil {
+		oh.Logger().Error("Failed to encode webhook batch", "servers", len(batch), "error", err)
+		oh.outputErrors.Add(uint64(len(batch)))
+		return
+	}
+
+	var failed atomic.Bool
+	var wg sync.WaitGroup
+	for _, url := range oh.params.URLs {
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			if err := oh.deliver(url, body); err != nil {
+				oh.Logger().Error("Failed to send webhook batch", "url", url, "servers", len(batch), "error", err)
+				failed.Store(true)
+			}
+		}(url)
+	}
+	wg.Wait()
+
+	if failed.Load() {
+		oh.outputErrors.Add(uint64(len(batch)))
+		return
+	}
+	oh.Logger().Debug("Sent webhook batch", "servers", len(batch))
+	oh.outputWrites.Add(uint64(len(batch)))
+}
+
+func (oh *WebhookOutputHandler) deliver(url string, body []byte) error {
+	for attempt := 1; ; attempt++ {
+		var err = oh.post(url, body)
+		if err == nil {
+			return nil
+		}
+
+		var statusError *webhookStatusError
+		var retryable = !errors.As(err, &statusError) || statusError.StatusCode == http.StatusTooManyRequests || statusError.StatusCode >= 500
+		if !retryable || attempt >= oh.retryPolicy.Attempts || oh.context.Err() != nil {
+			return err
+		}
+
+		var delay = oh.retryPolicy.Timeout(attempt)
+		oh.Logger().Warn("Webhook request failed, retrying", "url", url, "attempt", attempt, "delay", delay, "error", err)
+		select {
+		case <-time.After(delay):
+		case <-oh.context.Done():
+			return err
+		}
+	}
+}
+
+func (oh *WebhookOutputHandler) post(url string, body []byte) error {
+	request, err := http.NewRequestWithContext(oh.context, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "os-serverlist-sync")
+	if len(oh.params.Secret) > 0 {
+		var mac = hmac.New(sha256.New, []byte(oh.params.Secret))
+		mac.Write(body)
+		request.Header.Set(WEBHOOK_SIGNATURE_HEADER, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	response, err := oh.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, WEBHOOK_RESPONSE_BODY_LIMIT)) //lets the connection be reused
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return &webhookStatusError{response.StatusCode}
+	}
+	return nil
+}
+
+// Sends the partly filled batch now rather than waiting for batch_interval_ms, without waiting for it to be sent
+func (oh *WebhookOutputHandler) Flush() error {
+	select {
+	case oh.flush <- struct{}{}:
+	default: //a flush is already pending
+	}
+	return nil
+}
+
+// Sends what is queued, giving up after Engine.OUTPUT_DRAIN_TIMEOUT
+func (oh *WebhookOutputHandler) Close() error {
+	oh.mutex.Lock()
+	if oh.closed {
+		oh.mutex.Unlock()
+		return nil
+	}
+	oh.closed = true
+	close(oh.queue)
+	oh.mutex.Unlock()
+
+	defer oh.cancel()
+	select {
+	case <-oh.done:
+		return nil
+	case <-time.After(Engine.OUTPUT_DRAIN_TIMEOUT):
+	}
+
+	var errorsBefore = oh.outputErrors.Load()
+	oh.cancel()
+	<-oh.done
+	return fmt.Errorf("gave up sending webhook batches at shutdown, %d servers weren't sent", oh.outputErrors.Load()-errorsBefore)
+}
+
+func (oh *WebhookOutputHandler) GetOutputStats() Engine.OutputStats {
+	return Engine.OutputStats{
+		Writes: oh.outputWrites.Load(),
+		Errors: oh.outputErrors.Load(),
+	}
+}
+
+func (oh *WebhookOutputHandler) GetGamename() string {
+	return oh.params.Gamename
+}
+
+func (p *WebhookOutputHandlerParams) ValidateParams() []Engine.ParamError {
+	if p.Retry == nil {
+		return nil
+	}
+	var paramErrors = Engine.ValidateParams(p.Retry)
+	for i := range paramErrors {
+		paramErrors[i].Field = "retry." + paramErrors[i].Field
+	}
+	return paramErrors
+}
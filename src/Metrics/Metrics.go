@@ -0,0 +1,133 @@
+package Metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	NAMESPACE string = "serverlist_sync"
+)
+
+var (
+	registry = prometheus.NewRegistry()
+
+	masterListFetchDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Name:      "master_list_fetch_duration_seconds",
+		Help:      "Time taken by a server list engine to fetch its list.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 12),
+	}, []string{"pipeline", "gamename", "engine"})
+
+	masterListSize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: NAMESPACE,
+		Name:      "master_list_servers",
+		Help:      "Number of servers in the last list fetched by a server list engine.",
+	}, []string{"pipeline", "gamename", "engine"})
+
+	masterListErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "master_list_errors_total",
+		Help:      "Server list fetches which ended with an error.",
+	}, []string{"pipeline", "gamename", "engine"})
+
+	queriesSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "queries_sent_total",
+		Help:      "Queries sent by a query engine, including retries.",
+	}, []string{"pipeline", "gamename", "engine"})
+
+	queryRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "query_retries_total",
+		Help:      "Queries re-sent after timing out.",
+	}, []string{"pipeline", "gamename", "engine"})
+
+	queryResponses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "query_responses_total",
+		Help:      "Queries answered by a server.",
+	}, []string{"pipeline", "gamename", "engine"})
+
+	queryAbandons = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "query_abandoned_total",
+		Help:      "Queries given up on after running out of attempts.",
+	}, []string{"pipeline", "gamename", "engine"})
+
+	queryRTT = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Name:      "query_rtt_seconds",
+		Help:      "Time from the last query attempt being sent to its response.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12),
+	}, []string{"pipeline", "gamename", "engine"})
+
+	outputWriteDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Name:      "output_write_duration_seconds",
+		Help:      "Time taken by an output handler to write a server response.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"pipeline", "gamename", "output"})
+
+	outputWrites = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "output_writes_total",
+		Help:      "Server responses written by an output handler.",
+	}, []string{"pipeline", "gamename", "output"})
+
+	outputErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "output_errors_total",
+		Help:      "Server responses an output handler failed to write.",
+	}, []string{"pipeline", "gamename", "output"})
+
+	pendingQueries = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: NAMESPACE,
+		Name:      "pending_queries",
+		Help:      "Listed servers waiting on a response, including those held back by the rate limit.",
+	}, []string{"pipeline", "gamename"})
+)
+
+func init() {
+	registry.MustRegister(
+		masterListFetchDuration,
+		masterListSize,
+		masterListErrors,
+		queriesSent,
+		queryRetries,
+		queryResponses,
+		queryAbandons,
+		queryRTT,
+		outputWriteDuration,
+		outputWrites,
+		outputErrors,
+		pendingQueries,
+	)
+}
+
+func RegisterHandlers(mux *http.ServeMux) {
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{Registry: registry}))
+}
+
+// Drops every series of a pipeline which is no longer configured
+func DeletePipeline(pipeline string) {
+	var labels = prometheus.Labels{"pipeline": pipeline}
+	masterListFetchDuration.DeletePartialMatch(labels)
+	masterListSize.DeletePartialMatch(labels)
+	masterListErrors.DeletePartialMatch(labels)
+	queriesSent.DeletePartialMatch(labels)
+	queryRetries.DeletePartialMatch(labels)
+	queryResponses.DeletePartialMatch(labels)
+	queryAbandons.DeletePartialMatch(labels)
+	queryRTT.DeletePartialMatch(labels)
+	outputWriteDuration.DeletePartialMatch(labels)
+	outputWrites.DeletePartialMatch(labels)
+	outputErrors.DeletePartialMatch(labels)
+	pendingQueries.DeletePartialMatch(labels)
+}
+
+func SetPendingQueries(pipeline string, gamename string, pending int) {
+	pendingQueries.WithLabelValues(pipeline, gamename).Set(float64(pending))
+}
@@ -0,0 +1,111 @@
+package Metrics
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"os-serverlist-sync/Engine"
+	"time"
+)
+
+/*
+Wraps an output handler to time its writes. Errors are taken from the handler's own counters when it
+implements Engine.IQueryOutputStatsProvider, since OnServerInfoResponse doesn't return them.
+Handlers which write in the background, like the webhook output, are counted on the next call.
+Each output handler is called from its own goroutine in the pipeline's Engine.OutputFanOut, so
+counted needs no locking.
+*/
+type InstrumentedOutputHandler struct {
+	handler   Engine.IQueryOutputHandler
+	lifecycle Engine.IQueryOutputLifecycleHandler //handler, adapted if it doesn't implement the lifecycle callbacks
+	pipeline  string
+	gamename  string
+	output    string
+	counted   Engine.OutputStats //the handler's counters as last added to the metrics
+}
+
+func NewInstrumentedOutputHandler(handler Engine.IQueryOutputHandler, pipeline string, gamename string, output string) *InstrumentedOutputHandler {
+	return &InstrumentedOutputHandler{
+		handler:   handler,
+		lifecycle: Engine.AsLifecycleHandler(handler),
+		pipeline:  pipeline,
+		gamename:  gamename,
+		output:    output,
+	}
+}
+
+func (h *InstrumentedOutputHandler) OnServerInfoResponse(sourceAddress net.Addr, serverProperties map[string]string) {
+	h.OnServerInfo(sourceAddress, &Engine.ServerInfo{Keys: serverProperties})
+}
+
+func (h *InstrumentedOutputHandler) OnServerInfo(sourceAddress net.Addr, info *Engine.ServerInfo) {
+	var start = time.Now()
+
+	Engine.WriteServerInfo(h.handler, sourceAddress, info)
+
+	outputWriteDuration.WithLabelValues(h.pipeline, h.gamename, h.output).Observe(time.Since(start).Seconds())
+	h.addStats()
+}
+
+func (h *InstrumentedOutputHandler) addStats() {
+	var stats = h.GetOutputStats()
+	var delta = stats.Sub(h.counted)
+	h.counted = stats
+	outputWrites.WithLabelValues(h.pipeline, h.gamename, h.output).Add(float64(delta.Writes))
+	outputErrors.WithLabelValues(h.pipeline, h.gamename, h.output).Add(float64(delta.Errors))
+}
+
+func (h *InstrumentedOutputHandler) SetParams(params interface{}) {
+	h.handler.SetParams(params)
+}
+
+func (h *InstrumentedOutputHandler) GetOutputStats() Engine.OutputStats {
+	if provider, ok := h.handler.(Engine.IQueryOutputStatsProvider); ok {
+		return provider.GetOutputStats()
+	}
+	return Engine.OutputStats{}
+}
+
+func (h *InstrumentedOutputHandler) GetGamename() string {
+	return h.gamename
+}
+
+func (h *InstrumentedOutputHandler) OnServerTimeout(address netip.AddrPort) {
+	h.lifecycle.OnServerTimeout(address)
+	h.addStats()
+}
+
+func (h *InstrumentedOutputHandler) OnListEngineComplete(source string, count int, err error) {
+	h.lifecycle.OnListEngineComplete(source, count, err)
+	h.addStats()
+}
+
+func (h *InstrumentedOutputHandler) OnRunComplete(summary Engine.RunSummary) {
+	h.lifecycle.OnRunComplete(summary)
+	h.addStats()
+}
+
+// Always implemented, so a wrapped Engine.IQueryOutputFlusher still flushes
+func (h *InstrumentedOutputHandler) Flush() error {
+	defer h.addStats()
+	if flusher, ok := h.handler.(Engine.IQueryOutputFlusher); ok {
+		return flusher.Flush()
+	}
+	return nil
+}
+
+func (h *InstrumentedOutputHandler) Close() error {
+	defer h.addStats()
+	if closer, ok := h.handler.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (h *InstrumentedOutputHandler) CheckHealth(ctx context.Context) error {
+	if checker, ok := h.handler.(Engine.IHealthChecker); ok {
+		return checker.CheckHealth(ctx)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package Metrics
+
+import (
+	"os-serverlist-sync/Engine"
+	"sync"
+	"time"
+)
+
+type pipelineLabels struct {
+	pipeline    string
+	gamename    string
+	listEngine  string
+	queryEngine string
+}
+
+// Engine.ISyncObserver which records monitor events against the pipeline each list engine belongs to
+type SyncObserver struct {
+	mutex     sync.RWMutex
+	pipelines map[Engine.IServerListEngine]pipelineLabels
+}
+
+func NewSyncObserver() *SyncObserver {
+	return &SyncObserver{pipelines: make(map[Engine.IServerListEngine]pipelineLabels)}
+}
+
+func (o *SyncObserver) AddPipeline(listEngine Engine.IServerListEngine, pipeline string, gamename string, listEngineName string, queryEngineName string) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.pipelines[listEngine] = pipelineLabels{
+		pipeline:    pipeline,
+		gamename:    gamename,
+		listEngine:  listEngineName,
+		queryEngine: queryEngineName,
+	}
+}
+
+func (o *SyncObserver) RemovePipeline(listEngine Engine.IServerListEngine) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	delete(o.pipelines, listEngine)
+}
+
+func (o *SyncObserver) getLabels(listEngine Engine.IServerListEngine) pipelineLabels {
+	o.mutex.RLock()
+	defer o.mutex.RUnlock()
+
+	return o.pipelines[listEngine]
+}
+
+func (o *SyncObserver) OnServerListEngineEnd(engine Engine.IServerListEngine, stats Engine.ServerListEngineStats) {
+	var labels = o.getLabels(engine)
+	masterListFetchDuration.WithLabelValues(labels.pipeline, labels.gamename, labels.listEngine).Observe(stats.ListEnded.Sub(stats.Started).Seconds())
+	masterListSize.WithLabelValues(labels.pipeline, labels.gamename, labels.listEngine).Set(float64(stats.ServersListed))
+	if stats.Error != nil {
+		masterListErrors.WithLabelValues(labels.pipeline, labels.gamename, labels.listEngine).Inc()
+	}
+}
+
+func (o *SyncObserver) OnQuerySent(listEngine Engine.IServerListEngine, engine Engine.IQueryEngine, retry bool) {
+	var labels = o.getLabels(listEngine)
+	queriesSent.WithLabelValues(labels.pipeline, labels.gamename, labels.queryEngine).Inc()
+	if retry {
+		queryRetries.WithLabelValues(labels.pipeline, labels.gamename, labels.queryEngine).Inc()
+	}
+}
+
+func (o *SyncObserver) OnQueryResponse(listEngine Engine.IServerListEngine, engine Engine.IQueryEngine, rtt time.Duration) {
+	var labels = o.getLabels(listEngine)
+	queryResponses.WithLabelValues(labels.pipeline, labels.gamename, labels.queryEngine).Inc()
+	queryRTT.WithLabelValues(labels.pipeline, labels.gamename, labels.queryEngine).Observe(rtt.Seconds())
+}
+
+func (o *SyncObserver) OnQueryAbandoned(listEngine Engine.IServerListEngine, engine Engine.IQueryEngine) {
+	var labels = o.getLabels(listEngine)
+	queryAbandons.WithLabelValues(labels.pipeline, labels.gamename, labels.queryEngine).Inc()
+}
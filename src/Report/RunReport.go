@@ -0,0 +1,238 @@
+package Report
+
+import (
+	"encoding/json"
+	"net/netip"
+	"os"
+	"os-serverlist-sync/Engine"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+type PipelineReport struct {
+	Name            string         `json:"name"`
+	Gamename        string         `json:"gamename,omitempty"`
+	MasterReachable bool           `json:"master_reachable"`
+	Failed          bool           `json:"failed"`
+	Error           string         `json:"error,omitempty"`
+	ServersListed   int            `json:"servers_listed"`
+	QueriesSent     int            `json:"queries_sent"`
+	Responses       int            `json:"responses"`
+	Retries         int            `json:"retries"`
+	Abandoned       int            `json:"abandoned"`
+	OutputWrites    uint64         `json:"output_writes"`
+	OutputErrors    uint64         `json:"output_errors"`
+	OutputDropped   uint64         `json:"output_dropped"`
+	Sources         []SourceReport `json:"sources,omitempty"` //only for pipelines with more than one MsEngine
+	Servers         []ServerReport `json:"servers,omitempty"`
+	Started         time.Time      `json:"started"`
+	DurationSecs    float64        `json:"duration_secs"`
+}
+
+// One of a pipeline's MsEngines
+type SourceReport struct {
+	Name          string `json:"name"`
+	ServersListed int    `json:"servers_listed"` //including servers another source also listed
+	Error         string `json:"error,omitempty"`
+}
+
+// A server and the sources which listed it
+type ServerReport struct {
+	Address string   `json:"address"`
+	Sources []string `json:"sources"`
+}
+
+type Totals struct {
+	ServersListed int    `json:"servers_listed"`
+	QueriesSent   int    `json:"queries_sent"`
+	Responses     int    `json:"responses"`
+	Retries       int    `json:"retries"`
+	Abandoned     int    `json:"abandoned"`
+	OutputWrites  uint64 `json:"output_writes"`
+	OutputErrors  uint64 `json:"output_errors"`
+	OutputDropped uint64 `json:"output_dropped"`
+	FailedCount   int    `json:"failed_pipelines"`
+}
+
+/*
+Summary of a run, written as JSON to the --report path.
+In daemon mode each pipeline's entry is replaced by its latest sync cycle.
+*/
+type RunReport struct {
+	mutex sync.Mutex
+
+	Started      time.Time        `json:"started"`
+	Updated      time.Time        `json:"updated"`
+	DurationSecs float64          `json:"duration_secs"`
+	Failed       bool             `json:"failed"`
+	Totals       Totals           `json:"totals"`
+	Pipelines    []PipelineReport `json:"pipelines"`
+}
+
+func NewRunReport() *RunReport {
+	return &RunReport{Started: time.Now()}
+}
+
+/*
+Builds a pipeline's entry from its list engine's monitor counters.
+cycleEnd is used as the end time for list engines which never finished, output is the change in the
+pipeline's output handlers' counters over the cycle.
+*/
+func NewPipelineReport(name string, gamename string, stats Engine.ServerListEngineStats, invoked bool, output Engine.OutputStats, cycleEnd time.Time) PipelineReport {
+	var report PipelineReport
+	report.Name = name
+	report.Gamename = gamename
+	report.Started = stats.Started
+	report.ServersListed = stats.ServersListed
+	report.QueriesSent = stats.QueriesSent
+	report.Responses = stats.Responses
+	report.Retries = stats.Retries
+	report.Abandoned = stats.Abandoned
+	report.OutputWrites = output.Writes
+	report.OutputErrors = output.Errors
+	report.OutputDropped = output.Dropped
+	report.Sources, report.Servers = getSourceReports(stats)
+
+	if !invoked {
+		report.Failed = true
+		report.Error = "server list engine was not invoked"
+		return report
+	}
+
+	if stats.Error != nil {
+		report.Failed = true
+		report.Error = stats.Error.Error()
+	} else if !stats.Ended {
+		report.Failed = true
+		report.Error = "server list did not finish before the sync timeout"
+	}
+
+	//a list which failed part way through still reached the master
+	report.MasterReachable = stats.Error == nil || stats.ServersListed > 0
+
+	var finished = stats.Finished
+	if finished.IsZero() {
+		finished = cycleEnd
+	}
+	report.DurationSecs = finished.Sub(stats.Started).Seconds()
+
+	return report
+}
+
+func getSourceReports(stats Engine.ServerListEngineStats) ([]SourceReport, []ServerReport) {
+	var sources []SourceReport
+	for _, source := range stats.Sources {
+		var sourceReport = SourceReport{Name: source.Name, ServersListed: source.ServersListed}
+		if source.Error != nil {
+			sourceReport.Error = source.Error.Error()
+		}
+		sources = append(sources, sourceReport)
+	}
+
+	var addresses []netip.AddrPort
+	for address := range stats.ListedBy {
+		addresses = append(addresses, address)
+	}
+	sort.Slice(addresses, func(i, j int) bool {
+		if addresses[i].Addr() != addresses[j].Addr() {
+			return addresses[i].Addr().Less(addresses[j].Addr())
+		}
+		return addresses[i].Port() < addresses[j].Port()
+	})
+
+	var servers []ServerReport
+	for _, address := range addresses {
+		servers = append(servers, ServerReport{Address: address.String(), Sources: stats.ListedBy[address]})
+	}
+	return sources, servers
+}
+
+// Adds the pipeline, or replaces the entry with the same name
+func (r *RunReport) SetPipeline(pipeline PipelineReport) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var replaced = false
+	for i := range r.Pipelines {
+		if r.Pipelines[i].Name == pipeline.Name {
+			r.Pipelines[i] = pipeline
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		r.Pipelines = append(r.Pipelines, pipeline)
+	}
+	r.update()
+}
+
+// Drops a pipeline which is no longer configured
+func (r *RunReport) RemovePipeline(name string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for i := range r.Pipelines {
+		if r.Pipelines[i].Name == name {
+			r.Pipelines = append(r.Pipelines[:i], r.Pipelines[i+1:]...)
+			break
+		}
+	}
+	r.update()
+}
+
+// Caller must hold the mutex
+func (r *RunReport) update() {
+	r.Updated = time.Now()
+	r.DurationSecs = r.Updated.Sub(r.Started).Seconds()
+
+	r.Totals = Totals{}
+	for _, p := range r.Pipelines {
+		r.Totals.ServersListed += p.ServersListed
+		r.Totals.QueriesSent += p.QueriesSent
+		r.Totals.Responses += p.Responses
+		r.Totals.Retries += p.Retries
+		r.Totals.Abandoned += p.Abandoned
+		r.Totals.OutputWrites += p.OutputWrites
+		r.Totals.OutputErrors += p.OutputErrors
+		r.Totals.OutputDropped += p.OutputDropped
+		if p.Failed {
+			r.Totals.FailedCount++
+		}
+	}
+	r.Failed = r.Totals.FailedCount > 0
+}
+
+func (r *RunReport) HasFailures() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.Failed
+}
+
+// Written to a temp file and renamed into place, so readers never see a partial report
+func (r *RunReport) WriteFile(path string) error {
+	r.mutex.Lock()
+	data, err := json.MarshalIndent(r, "", "  ")
+	r.mutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	tempFile, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+
+	if _, err := tempFile.Write(append(data, '\n')); err != nil {
+		tempFile.Close()
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tempFile.Name(), path)
+}
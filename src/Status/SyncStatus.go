@@ -0,0 +1,102 @@
+package Status
+
+import (
+	"time"
+)
+
+type PendingQuery struct {
+	Address  string  `json:"address"`
+	Attempts int     `json:"attempts"` //zero while held back by the rate limit
+	AgeSecs  float64 `json:"age_secs"`
+}
+
+type ListEngineStatus struct {
+	Engine        string    `json:"engine"`
+	Active        bool      `json:"active"` //still fetching its list
+	Started       time.Time `json:"started"`
+	ServersListed int       `json:"servers_listed"`
+	Responses     int       `json:"responses"`
+	Pending       int       `json:"pending"`
+}
+
+type PipelineStatus struct {
+	Name                    string            `json:"name"`
+	Gamename                string            `json:"gamename,omitempty"`
+	Syncing                 bool              `json:"syncing"`
+	ListEngine              *ListEngineStatus `json:"list_engine,omitempty"`
+	PendingQueries          []PendingQuery    `json:"pending_queries"`
+	PendingQueriesTruncated bool              `json:"pending_queries_truncated,omitempty"`
+	LastSync                *time.Time        `json:"last_sync,omitempty"`
+	LastSuccessfulSync      *time.Time        `json:"last_successful_sync,omitempty"`
+	LastError               string            `json:"last_error,omitempty"`
+}
+
+type SyncStatus struct {
+	Started           time.Time        `json:"started"`
+	ActiveListEngines int              `json:"active_list_engines"`
+	PendingQueries    int              `json:"pending_queries"`
+	Pipelines         []PipelineStatus `json:"pipelines"`
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func (t *Tracker) GetStatus() SyncStatus {
+	t.mutex.Lock()
+	var states []pipelineState
+	for _, state := range t.pipelines {
+		states = append(states, *state)
+	}
+	t.mutex.Unlock()
+
+	var status = SyncStatus{Started: t.started}
+	for _, state := range states {
+		var pipeline = PipelineStatus{
+			Name:               state.config.Name,
+			Gamename:           state.config.GetGamename(),
+			Syncing:            state.monitor != nil,
+			PendingQueries:     []PendingQuery{},
+			LastSync:           optionalTime(state.lastSync),
+			LastSuccessfulSync: optionalTime(state.lastSuccess),
+			LastError:          state.lastError,
+		}
+
+		if state.monitor != nil {
+			stats, invoked := state.monitor.GetServerListEngineStats(state.config.ServerListEngine)
+			if invoked {
+				pipeline.ListEngine = &ListEngineStatus{
+					Engine:        state.config.MsEngineName,
+					Active:        !stats.Ended,
+					Started:       stats.Started,
+					ServersListed: stats.ServersListed,
+					Responses:     stats.Responses,
+					Pending:       stats.Pending,
+				}
+				if !stats.Ended {
+					status.ActiveListEngines++
+				}
+			}
+
+			var pending = state.monitor.GetPendingQueries(state.config.ServerListEngine)
+			status.PendingQueries += len(pending)
+			if len(pending) > MAX_PENDING_QUERIES {
+				pending = pending[:MAX_PENDING_QUERIES]
+				pipeline.PendingQueriesTruncated = true
+			}
+			for _, query := range pending {
+				pipeline.PendingQueries = append(pipeline.PendingQueries, PendingQuery{
+					Address:  query.Address.String(),
+					Attempts: query.Attempts,
+					AgeSecs:  query.Age.Seconds(),
+				})
+			}
+		}
+
+		status.Pipelines = append(status.Pipelines, pipeline)
+	}
+	return status
+}
@@ -0,0 +1,202 @@
+package Status
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os-serverlist-sync/Config"
+	"os-serverlist-sync/Engine"
+	"os-serverlist-sync/Report"
+	"sync"
+	"time"
+)
+
+const (
+	READINESS_TIMEOUT   = 2 * time.Second
+	MAX_PENDING_QUERIES = 1000 //listed per pipeline by /status, the count is always complete
+)
+
+type pipelineState struct {
+	config      Config.EngineConfiguration
+	monitor     *Engine.SyncStatusMonitor //nil between sync cycles
+	lastSync    time.Time
+	lastSuccess time.Time
+	lastError   string
+}
+
+/*
+Keeps track of each pipeline's current sync cycle and the outcome of its last one, and serves
+/healthz, /readyz and /status from them.
+*/
+type Tracker struct {
+	mutex     sync.Mutex
+	started   time.Time
+	pipelines []*pipelineState
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{started: time.Now()}
+}
+
+// Adds a pipeline, or replaces the engines of the pipeline with the same name keeping its sync history
+func (t *Tracker) SetPipeline(pipeline Config.EngineConfiguration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if state := t.getPipeline(pipeline.Name); state != nil {
+		state.config = pipeline
+		state.monitor = nil
+		return
+	}
+	t.pipelines = append(t.pipelines, &pipelineState{config: pipeline})
+}
+
+func (t *Tracker) RemovePipeline(name string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for i, state := range t.pipelines {
+		if state.config.Name == name {
+			t.pipelines = append(t.pipelines[:i], t.pipelines[i+1:]...)
+			return
+		}
+	}
+}
+
+func (t *Tracker) getPipeline(name string) *pipelineState {
+	for _, state := range t.pipelines {
+		if state.config.Name == name {
+			return state
+		}
+	}
+	return nil
+}
+
+// Called when a sync cycle starts for the given pipelines
+func (t *Tracker) BeginCycle(params []Config.EngineConfiguration, monitor *Engine.SyncStatusMonitor) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, pipeline := range params {
+		if state := t.getPipeline(pipeline.Name); state != nil {
+			state.monitor = monitor
+		}
+	}
+}
+
+// Called with each pipeline's report once its sync cycle is over
+func (t *Tracker) EndCycle(report Report.PipelineReport, cycleEnd time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var state = t.getPipeline(report.Name)
+	if state == nil {
+		return
+	}
+	state.monitor = nil
+	state.lastSync = cycleEnd
+	state.lastError = report.Error
+	if !report.Failed {
+		state.lastSuccess = cycleEnd
+	}
+}
+
+func (t *Tracker) RegisterHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", t.handleHealth)
+	mux.HandleFunc("/readyz", t.handleReady)
+	mux.HandleFunc("/status", t.handleStatus)
+}
+
+// The process is alive as long as it can answer
+func (t *Tracker) handleHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("ok\n"))
+}
+
+func (t *Tracker) handleReady(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), READINESS_TIMEOUT)
+	defer cancel()
+
+	var readiness = t.GetReadiness(ctx)
+	var statusCode = http.StatusOK
+	if !readiness.Ready {
+		statusCode = http.StatusServiceUnavailable
+	}
+	writeJSON(w, statusCode, readiness)
+}
+
+func (t *Tracker) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, t.GetStatus())
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(value); err != nil {
+		slog.Error("Failed to write status response", "error", err)
+	}
+}
+
+type PipelineReadiness struct {
+	Name   string   `json:"name"`
+	Ready  bool     `json:"ready"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+type Readiness struct {
+	Ready     bool                `json:"ready"`
+	Pipelines []PipelineReadiness `json:"pipelines"`
+}
+
+/*
+A pipeline is ready when its query engine's UDP socket is bound and the engines and output handler
+which depend on Redis can reach it. Anything not implementing Engine.IHealthChecker is assumed ready.
+*/
+func (t *Tracker) GetReadiness(ctx context.Context) Readiness {
+	t.mutex.Lock()
+	var params []Config.EngineConfiguration
+	for _, state := range t.pipelines {
+		params = append(params, state.config)
+	}
+	t.mutex.Unlock()
+
+	var readiness = Readiness{Ready: true}
+	for _, pipeline := range params {
+		var pipelineReadiness = PipelineReadiness{Name: pipeline.Name, Ready: true}
+
+		var checks = []struct {
+			name      string
+			component interface{}
+		}{
+			{"query engine", pipeline.QueryEngine},
+			{"server list engine", pipeline.ServerListEngine},
+		}
+		for _, output := range pipeline.Outputs {
+			checks = append(checks, struct {
+				name      string
+				component interface{}
+			}{"output handler " + output.Name, output.Handler})
+		}
+		for _, check := range checks {
+			checker, ok := check.component.(Engine.IHealthChecker)
+			if !ok {
+				continue
+			}
+			if err := checker.CheckHealth(ctx); err != nil {
+				pipelineReadiness.Ready = false
+				pipelineReadiness.Errors = append(pipelineReadiness.Errors, fmt.Sprintf("%s: %s", check.name, err.Error()))
+			}
+		}
+
+		if !pipelineReadiness.Ready {
+			readiness.Ready = false
+		}
+		readiness.Pipelines = append(readiness.Pipelines, pipelineReadiness)
+	}
+	return readiness
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"log/slog"
+	"os"
+	"os-serverlist-sync/Config"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const (
+	CONFIG_POLL_INTERVAL time.Duration = 5 * time.Second
+)
+
+// A pipeline running in its own goroutine until cancelled
+type pipelineRun struct {
+	pipeline    Config.EngineConfiguration
+	fingerprint string
+	cancel      context.CancelFunc
+	done        chan struct{}
+}
+
+// Runs every pipeline on its own SyncInterval, reloading the config on SIGHUP or when the file changes
+type Daemon struct {
+	syncer      *Syncer
+	configPath  string
+	watchConfig bool
+	runs        map[string]*pipelineRun
+	configHash  [sha256.Size]byte
+}
+
+func (d *Daemon) startPipeline(ctx context.Context, pipeline Config.EngineConfiguration, fingerprint string) {
+	pipelineCtx, cancel := context.WithCancel(ctx)
+	var run = &pipelineRun{pipeline: pipeline, fingerprint: fingerprint, cancel: cancel, done: make(chan struct{})}
+	d.runs[pipeline.Name] = run
+
+	go func() {
+		defer close(run.done)
+		d.syncer.runPipeline(pipelineCtx, pipeline)
+	}()
+}
+
+// Stops a pipeline and shuts its engines down, so its source port can be bound again
+func (d *Daemon) stopPipeline(name string, removed bool) {
+	var run = d.runs[name]
+	run.cancel()
+	<-run.done
+	d.syncer.shutdownPipeline(run.pipeline, removed)
+	delete(d.runs, name)
+}
+
+// Builds and starts the given pipelines, their names must not be running already
+func (d *Daemon) startPipelines(ctx context.Context, plains []Config.EngineConfigurationPlain) {
+	var params = d.syncer.buildPipelines(plains)
+	for i, pipeline := range params {
+		fingerprint, _ := plains[i].Fingerprint()
+		d.startPipeline(ctx, pipeline, fingerprint)
+	}
+}
+
+func (d *Daemon) readConfigHash() ([sha256.Size]byte, error) {
+	data, err := os.ReadFile(d.configPath)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	return sha256.Sum256(data), nil
+}
+
+/*
+Applies the config file to the running pipelines. An invalid config is logged and the current pipelines
+keep running. Otherwise removed and changed pipelines are stopped before anything new is built, so a
+changed source_port or one moved to another pipeline is free to bind, and unchanged pipelines are left alone.
+*/
+func (d *Daemon) reload(ctx context.Context) {
+	slog.Info("Reloading config", "path", d.configPath)
+
+	plains, err := loadConfig(d.configPath, d.syncer.refreshMode)
+	if err != nil {
+		logConfigError(d.configPath, err)
+		slog.Warn("Config reload failed, keeping the running pipelines")
+		return
+	}
+
+	var wanted = make(map[string]bool)
+	var changed []Config.EngineConfigurationPlain
+	for _, plain := range plains {
+		wanted[plain.Name] = true
+		fingerprint, _ := plain.Fingerprint()
+		if run, exists := d.runs[plain.Name]; exists && run.fingerprint == fingerprint {
+			continue
+		}
+		changed = append(changed, plain)
+	}
+
+	for name := range d.runs {
+		if !wanted[name] {
+			slog.Info("Removing pipeline", "pipeline", name)
+			d.stopPipeline(name, true)
+		}
+	}
+	for _, plain := range changed {
+		if _, exists := d.runs[plain.Name]; exists {
+			slog.Info("Restarting changed pipeline", "pipeline", plain.Name)
+			d.stopPipeline(plain.Name, false)
+		} else {
+			slog.Info("Adding pipeline", "pipeline", plain.Name)
+		}
+	}
+
+	d.startPipelines(ctx, changed)
+	slog.Info("Config reloaded", "pipelines", len(plains), "started", len(changed))
+}
+
+func (d *Daemon) run(ctx context.Context, plains []Config.EngineConfigurationPlain) {
+	d.runs = make(map[string]*pipelineRun)
+	d.configHash, _ = d.readConfigHash()
+	d.startPipelines(ctx, plains)
+
+	var hangup = make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	var poll <-chan time.Time
+	if d.watchConfig {
+		var ticker = time.NewTicker(CONFIG_POLL_INTERVAL)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			for name := range d.runs {
+				d.stopPipeline(name, false)
+			}
+			return
+		case <-hangup:
+			d.configHash, _ = d.readConfigHash()
+			d.reload(ctx)
+		case <-poll:
+			hash, err := d.readConfigHash()
+			if err != nil || hash == d.configHash {
+				continue //a file being replaced may briefly be missing
+			}
+			d.configHash = hash
+			d.reload(ctx)
+		}
+	}
+}
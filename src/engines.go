@@ -0,0 +1,52 @@
+package main
+
+// Engines linked into the binary, each package registers its engines with the Engine registry from init().
+// Third-party engines are added the same way.
+import (
+	"fmt"
+	"io"
+	"os-serverlist-sync/Engine"
+	"strings"
+	"text/tabwriter"
+
+	_ "os-serverlist-sync/Engines"
+	_ "os-serverlist-sync/Engines/GOA"
+	_ "os-serverlist-sync/Engines/GameServerListerApi"
+	_ "os-serverlist-sync/Engines/OpenSpy"
+	_ "os-serverlist-sync/Engines/QR2"
+	_ "os-serverlist-sync/Engines/SAMP"
+	_ "os-serverlist-sync/Engines/SQLite"
+	_ "os-serverlist-sync/Engines/UT2K"
+)
+
+func printEngine(w io.Writer, name string, schema []Engine.ParamField) {
+	fmt.Fprintf(w, "  %s\n", name)
+	for _, field := range schema {
+		var rules = field.Rules
+		if field.Secret {
+			rules = strings.Trim(rules+",secret", ",")
+		}
+		fmt.Fprintf(w, "    \t%s\t%s\t%s\n", field.Name, field.Type, rules)
+	}
+}
+
+// Prints every registered engine and output handler with the params its config block accepts, for --list-engines
+func printEngines(output io.Writer) {
+	w := tabwriter.NewWriter(output, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprintln(w, "MsEngine:")
+	for _, registration := range Engine.ServerListEngines() {
+		printEngine(w, registration.Name, registration.ParamsSchema())
+	}
+
+	fmt.Fprintln(w, "QueryEngine:")
+	for _, registration := range Engine.QueryEngines() {
+		printEngine(w, registration.Name, registration.ParamsSchema())
+	}
+
+	fmt.Fprintln(w, "OutputEngine:")
+	for _, registration := range Engine.OutputHandlers() {
+		printEngine(w, registration.Name, registration.ParamsSchema())
+	}
+}
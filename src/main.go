@@ -2,95 +2,233 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"flag"
-	"io"
-	"log"
+	"fmt"
+	"log/slog"
+	"net/http"
 	"os"
 	"os-serverlist-sync/Config"
 	"os-serverlist-sync/Engine"
+	"os-serverlist-sync/Engines"
 	"os-serverlist-sync/Engines/OpenSpy"
-	"time"
+	"os-serverlist-sync/Metrics"
+	"os-serverlist-sync/Report"
+	"os-serverlist-sync/Status"
+	"os/signal"
+	"syscall"
 )
 
-func invokeMsEngines(monitor Engine.SyncStatusMonitor, params []Config.EngineConfiguration, ctx context.Context) {
-
-	for _, engine := range params {
-		engine.ServerListEngine.Invoke(monitor, ctx)
-	}
-}
-
-func shutdownEngines(params []Config.EngineConfiguration) {
-	for _, engine := range params {
-		engine.ServerListEngine.Shutdown()
-		engine.QueryEngine.Shutdown()
-	}
-}
-
 func applyRefreshModeInputEngine(params []Config.EngineConfiguration) []Config.EngineConfiguration {
 	for i := 0; i < len(params); i++ {
-		var osEngine = params[i].QueryOutputHandler.(*OpenSpy.OpenSpyRedisOutputHandler)
-		var gamename = osEngine.GetGamename()
+		var gamename = params[i].GetGamename()
 
 		var inputParams = &OpenSpy.OpenSpyRedisInputHandlerParams{}
 		inputParams.Gamename = gamename
+		for _, output := range params[i].Outputs {
+			if outputHandler, isOpenSpy := output.Handler.(*OpenSpy.OpenSpyRedisOutputHandler); isOpenSpy {
+				inputParams.RedisParams = outputHandler.GetRedisParams()
+				break
+			}
+		}
 		var inputEngine = OpenSpy.OpenSpyRedisInputHandler{}
 		inputEngine.SetParams(inputParams)
 		inputEngine.SetQueryEngine(params[i].QueryEngine)
 
 		params[i].ServerListEngine = &inputEngine
+		params[i].MsEngines = []Engine.ServerListSource{{Name: "refresh", Engine: &inputEngine}}
+		params[i].MsEngineName = "refresh"
 	}
 	return params
 }
 
+// Replaces every pipeline's outputs with a stdout output, so servers are printed instead of written anywhere
+func applyDryRunOutputs(plains []Config.EngineConfigurationPlain, format string) []Config.EngineConfigurationPlain {
+	var dryRunPlains = make([]Config.EngineConfigurationPlain, len(plains))
+	for i, plain := range plains {
+		var params = &Engines.StdoutOutputHandlerParams{Format: format, Label: plain.Name}
+		for _, output := range plain.OutputEngines {
+			if openSpyParams, isOpenSpy := output.Params.(*OpenSpy.OpenSpyRedisOutputHandlerParams); isOpenSpy {
+				params.Gamename = openSpyParams.Gamename //keeps the gamename in logs and metrics
+				break
+			}
+		}
+		plain.OutputEngines = []Config.OutputEngineBlock{{Name: "stdout", Params: params}}
+		dryRunPlains[i] = plain
+	}
+	return dryRunPlains
+}
+
+func setupLogging(level string, format string) error {
+	var options = &slog.HandlerOptions{}
+
+	var logLevel slog.Level
+	if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid --log-level %q: %w", level, err)
+	}
+	options.Level = logLevel
+
+	var handler slog.Handler
+	switch format {
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, options)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	default:
+		return fmt.Errorf("invalid --log-format %q, expected text or json", format)
+	}
+
+	slog.SetDefault(slog.New(handler)) //also routes the standard log package through the handler
+	return nil
+}
+
+// Gives each pipeline's engines and output handler a logger carrying the pipeline's fields
+func applyLoggers(params []Config.EngineConfiguration) {
+	for _, pipeline := range params {
+		var logger = slog.With("pipeline", pipeline.Name, "gamename", pipeline.GetGamename())
+
+		for _, source := range pipeline.MsEngines {
+			if context, ok := source.Engine.(Engine.ILogContext); ok {
+				context.SetLogger(logger.With("engine", source.Name))
+			}
+		}
+		if context, ok := pipeline.QueryEngine.(Engine.ILogContext); ok {
+			context.SetLogger(logger.With("engine", pipeline.QueryEngineName))
+		}
+		for _, output := range pipeline.Outputs {
+			if context, ok := output.Handler.(Engine.ILogContext); ok {
+				context.SetLogger(logger.With("output", output.Name))
+			}
+		}
+		pipeline.OutputFanOut.SetLogger(logger)
+	}
+}
+
+// Wraps each pipeline's output handlers so their writes are timed and counted
+func applyMetricsOutputHandlers(params []Config.EngineConfiguration) {
+	for i := 0; i < len(params); i++ {
+		var gamename = params[i].GetGamename()
+		for j, output := range params[i].Outputs {
+			params[i].Outputs[j].Handler = Metrics.NewInstrumentedOutputHandler(output.Handler, params[i].Name, gamename, output.Name)
+		}
+		params[i].ConnectOutputs()
+	}
+}
+
+func getListenerMux(listeners map[string]*http.ServeMux, address string) *http.ServeMux {
+	mux, exists := listeners[address]
+	if !exists {
+		mux = http.NewServeMux()
+		listeners[address] = mux
+	}
+	return mux
+}
+
+// Starts the HTTP listeners in the background, a failure to bind is logged but isn't fatal
+func serveListeners(listeners map[string]*http.ServeMux) {
+	for address, mux := range listeners {
+		go func(address string, mux *http.ServeMux) {
+			slog.Info("Serving HTTP", "address", address)
+			if err := http.ListenAndServe(address, mux); err != nil {
+				slog.Error("HTTP listener failed", "address", address, "error", err)
+			}
+		}(address, mux)
+	}
+}
+
 func main() {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
-	defer cancel()
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(runValidate(os.Args[2:]))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
 	refreshMode := flag.Bool("refresh-only", false, "Only refresh existing injected servers")
+	daemonMode := flag.Bool("daemon", false, "Keep running, re-syncing each pipeline on its SyncInterval")
+	listEngines := flag.Bool("list-engines", false, "Print the available engines and their params, then exit")
+	dryRun := flag.Bool("dry-run", false, "Print query responses to stdout instead of writing them to the configured outputs")
+	dryRunFormat := flag.String("dry-run-format", Engines.STDOUT_FORMAT_TABLE, "Format of --dry-run output: table or json (one object per line)")
+	watchConfig := flag.Bool("watch-config", false, "In daemon mode, reload the config when the file changes. SIGHUP always reloads it")
 	configPath := flag.String("config", "ms_config.json", "Path to config file")
+	reportPath := flag.String("report", "", "Path to write a JSON run report to")
+	metricsAddress := flag.String("metrics-addr", "", "Address to serve Prometheus /metrics on, e.g. :9100")
+	logLevel := flag.String("log-level", "info", "Minimum log level: debug, info, warn or error")
+	logFormat := flag.String("log-format", "text", "Log output format: text or json")
+	statusAddress := flag.String("status-addr", "", "Address to serve /healthz, /readyz and /status on, may be the same as --metrics-addr")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags]\n       %s validate [-config path] [-refresh-only]\n", os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
-	file, err := os.Open(*configPath)
+	if err := setupLogging(*logLevel, *logFormat); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(2)
+	}
+
+	if *listEngines {
+		printEngines(os.Stdout)
+		return
+	}
+
+	if *dryRun {
+		if *refreshMode {
+			fmt.Fprintln(os.Stderr, "--dry-run can't be used with --refresh-only, which reads servers from Redis")
+			os.Exit(2)
+		}
+		if *dryRunFormat != Engines.STDOUT_FORMAT_TABLE && *dryRunFormat != Engines.STDOUT_FORMAT_JSON {
+			fmt.Fprintf(os.Stderr, "invalid --dry-run-format %q, expected table or json\n", *dryRunFormat)
+			os.Exit(2)
+		}
+	}
+
+	if flag.Arg(0) == "validate" { //flags given before the subcommand, as run.sh does
+		os.Exit(validateConfig(*configPath, *refreshMode))
+	}
+
+	//validated before any engine is created, so a bad config never opens a socket
+	plains, err := loadConfig(*configPath, *refreshMode)
 	if err != nil {
-		log.Fatal(err)
+		logConfigError(*configPath, err)
+		os.Exit(1)
 	}
-	defer file.Close()
 
-	byteValue, _ := io.ReadAll(file)
+	var syncer = &Syncer{}
+	syncer.report = Report.NewRunReport()
+	syncer.reportPath = *reportPath
+	syncer.refreshMode = *refreshMode
+	if *dryRun {
+		syncer.dryRunFormat = *dryRunFormat
+	}
 
-	var params []Config.EngineConfiguration
-	json.Unmarshal(byteValue, &params)
+	var listeners = make(map[string]*http.ServeMux)
 
-	if *refreshMode {
-		params = applyRefreshModeInputEngine(params)
+	if len(*metricsAddress) > 0 {
+		syncer.observer = Metrics.NewSyncObserver()
+		Metrics.RegisterHandlers(getListenerMux(listeners, *metricsAddress))
 	}
-	//
 
-	var monitor Engine.SyncStatusMonitor
-	monitor.Init()
+	if len(*statusAddress) > 0 {
+		syncer.status = Status.NewTracker()
+		syncer.status.RegisterHandlers(getListenerMux(listeners, *statusAddress))
+	}
 
-	ticker := time.NewTicker(2 * time.Second)
+	serveListeners(listeners)
 
-	go func() {
-		for _ = range ticker.C {
-			monitor.Think()
-			if monitor.AllEnginesComplete() {
-				cancel()
-				break
-			}
+	if *daemonMode {
+		var daemon = &Daemon{syncer: syncer, configPath: *configPath, watchConfig: *watchConfig}
+		daemon.run(ctx, plains)
+	} else {
+		var params = syncer.buildPipelines(plains)
+		syncer.runOnce(ctx, params)
+		for _, pipeline := range params {
+			syncer.shutdownPipeline(pipeline, false)
 		}
-	}()
+	}
 
-	invokeMsEngines(monitor, params, ctx)
+	slog.Info("Exiting server list syncer")
 
-	select {
-	case <-ctx.Done():
-		log.Println("Shutdown event", ctx.Err())
-		ticker.Stop()
-		break
+	if syncer.report.HasFailures() {
+		os.Exit(1)
 	}
-
-	shutdownEngines(params)
-	log.Printf("Exiting server list syncer\n")
 }
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os-serverlist-sync/Config"
+	"os-serverlist-sync/Engine"
+	"os-serverlist-sync/Metrics"
+	"os-serverlist-sync/Report"
+	"os-serverlist-sync/Status"
+	"time"
+)
+
+const (
+	SYNC_TIMEOUT = 5 * time.Minute
+)
+
+// State shared by every sync cycle of the run
+type Syncer struct {
+	report       *Report.RunReport
+	reportPath   string
+	refreshMode  bool
+	dryRunFormat string                //set by --dry-run, every pipeline's outputs are replaced with stdout
+	observer     *Metrics.SyncObserver //nil unless metrics are enabled
+	status       *Status.Tracker       //nil unless the status listener is enabled
+}
+
+// Builds the engines of parsed pipelines and attaches them to the run's logging, metrics and status
+func (s *Syncer) buildPipelines(plains []Config.EngineConfigurationPlain) []Config.EngineConfiguration {
+	if len(s.dryRunFormat) > 0 {
+		plains = applyDryRunOutputs(plains, s.dryRunFormat)
+	}
+	var params = Config.Build(plains)
+
+	if s.refreshMode {
+		params = applyRefreshModeInputEngine(params)
+	}
+	applyLoggers(params)
+
+	if s.observer != nil {
+		applyMetricsOutputHandlers(params)
+		for _, pipeline := range params {
+			s.observer.AddPipeline(pipeline.ServerListEngine, pipeline.Name, pipeline.GetGamename(), pipeline.MsEngineName, pipeline.QueryEngineName)
+		}
+	}
+	if s.status != nil {
+		for _, pipeline := range params {
+			s.status.SetPipeline(pipeline)
+		}
+	}
+	return params
+}
+
+/*
+Shuts down a pipeline's engines once it has stopped running. A removed pipeline is also dropped from
+the report, status and metrics, a pipeline being rebuilt keeps its entries under the same name.
+*/
+func (s *Syncer) shutdownPipeline(pipeline Config.EngineConfiguration, removed bool) {
+	pipeline.ServerListEngine.Shutdown()
+	pipeline.QueryEngine.Shutdown()
+	pipeline.OutputFanOut.Shutdown()
+	for _, output := range pipeline.Outputs {
+		if closer, ok := output.Handler.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				slog.Error("Failed to close output", "pipeline", pipeline.Name, "output", output.Name, "error", err)
+			}
+		}
+	}
+
+	if s.observer != nil {
+		s.observer.RemovePipeline(pipeline.ServerListEngine)
+	}
+	if !removed {
+		return
+	}
+	s.report.RemovePipeline(pipeline.Name)
+	if s.status != nil {
+		s.status.RemovePipeline(pipeline.Name)
+	}
+	if s.observer != nil {
+		Metrics.DeletePipeline(pipeline.Name)
+	}
+}
+
+func invokeMsEngines(monitor *Engine.SyncStatusMonitor, params []Config.EngineConfiguration, ctx context.Context) {
+
+	for _, engine := range params {
+		engine.ServerListEngine.Invoke(monitor, ctx)
+	}
+}
+
+func (s *Syncer) updatePendingMetrics(monitor *Engine.SyncStatusMonitor, params []Config.EngineConfiguration, cycleEnded bool) {
+	if s.observer == nil {
+		return
+	}
+	for _, pipeline := range params {
+		var pending = 0
+		if stats, invoked := monitor.GetServerListEngineStats(pipeline.ServerListEngine); invoked && !cycleEnded {
+			pending = stats.Pending
+		}
+		Metrics.SetPendingQueries(pipeline.Name, pipeline.GetGamename(), pending)
+	}
+}
+
+func (s *Syncer) runSyncCycle(parentCtx context.Context, params []Config.EngineConfiguration) {
+	ctx, cancel := context.WithTimeout(parentCtx, SYNC_TIMEOUT)
+	defer cancel()
+
+	var outputStatsBefore []Engine.OutputStats
+	for _, pipeline := range params {
+		outputStatsBefore = append(outputStatsBefore, pipeline.OutputFanOut.GetOutputStats())
+	}
+
+	var monitor = &Engine.SyncStatusMonitor{}
+	monitor.Init()
+
+	if s.observer != nil {
+		monitor.SetObserver(s.observer)
+	}
+	if s.status != nil {
+		s.status.BeginCycle(params, monitor)
+	}
+
+	for _, engine := range params {
+		monitor.SetRetryPolicy(engine.QueryEngine, engine.RetryPolicy)
+		monitor.SetRateLimit(engine.QueryEngine, engine.RateLimit)
+		monitor.SetOutput(engine.ServerListEngine, engine.MsEngineName, engine.OutputFanOut)
+	}
+
+	ticker := time.NewTicker(Engine.THINK_INTERVAL)
+	defer ticker.Stop()
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				monitor.Think()
+				s.updatePendingMetrics(monitor, params, false)
+				if monitor.AllEnginesComplete() {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	invokeMsEngines(monitor, params, ctx)
+
+	select {
+	case <-ctx.Done():
+		slog.Debug("Sync cycle ended", "reason", ctx.Err())
+		break
+	}
+
+	//anything still pending is dropped with the cycle
+	s.updatePendingMetrics(monitor, params, true)
+
+	//responses still queued for the output handlers are counted in this cycle
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), Engine.OUTPUT_DRAIN_TIMEOUT)
+	defer cancelDrain()
+	for _, pipeline := range params {
+		stats, invoked := monitor.GetServerListEngineStats(pipeline.ServerListEngine)
+		pipeline.OutputFanOut.OnRunComplete(Engine.NewRunSummary(pipeline.Name, stats, invoked, time.Now()))
+		if !pipeline.OutputFanOut.WaitIdle(drainCtx) {
+			slog.Warn("Output handlers are still writing at the end of the sync cycle", "pipeline", pipeline.Name)
+		}
+	}
+
+	var cycleEnd = time.Now()
+	for i, pipeline := range params {
+		stats, invoked := monitor.GetServerListEngineStats(pipeline.ServerListEngine)
+		var outputStats = pipeline.OutputFanOut.GetOutputStats().Sub(outputStatsBefore[i])
+		var pipelineReport = Report.NewPipelineReport(pipeline.Name, pipeline.GetGamename(), stats, invoked, outputStats, cycleEnd)
+		s.report.SetPipeline(pipelineReport)
+		slog.Info("Pipeline synced", "pipeline", pipeline.Name, "gamename", pipeline.GetGamename(), "failed", pipelineReport.Failed,
+			"servers_listed", pipelineReport.ServersListed, "responses", pipelineReport.Responses, "abandoned", pipelineReport.Abandoned)
+		if s.status != nil {
+			s.status.EndCycle(pipelineReport, cycleEnd)
+		}
+	}
+}
+
+func (s *Syncer) writeReport() {
+	if len(s.reportPath) == 0 {
+		return
+	}
+	if err := s.report.WriteFile(s.reportPath); err != nil {
+		slog.Error("Failed to write report", "path", s.reportPath, "error", err)
+	}
+}
+
+// Runs every pipeline once, together
+func (s *Syncer) runOnce(ctx context.Context, params []Config.EngineConfiguration) {
+	s.runSyncCycle(ctx, params)
+	s.writeReport()
+}
+
+// Keeps a single pipeline resident, starting a new sync cycle every SyncInterval until the context is cancelled
+func (s *Syncer) runPipeline(ctx context.Context, pipeline Config.EngineConfiguration) {
+	var logger = slog.With("pipeline", pipeline.Name, "gamename", pipeline.GetGamename())
+	for {
+		var cycleStart = time.Now()
+		logger.Info("Begin sync cycle")
+		s.runSyncCycle(ctx, []Config.EngineConfiguration{pipeline})
+		s.writeReport()
+		logger.Info("Sync cycle finished", "duration", time.Since(cycleStart))
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(cycleStart.Add(pipeline.SyncInterval))):
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os-serverlist-sync/Config"
+	"os-serverlist-sync/Engines/OpenSpy"
+)
+
+func hasOpenSpyOutput(plain Config.EngineConfigurationPlain) bool {
+	for _, output := range plain.OutputEngines {
+		if _, isOpenSpy := output.Params.(*OpenSpy.OpenSpyRedisOutputHandlerParams); isOpenSpy {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Reads and validates the config. In refresh mode each pipeline is read back from Redis with the
+connection settings of its OpenSpy output handler, or the REDIS_* environment variables without one.
+*/
+func loadConfig(path string, refreshMode bool) ([]Config.EngineConfigurationPlain, error) {
+	data, err := Config.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	plains, validationErrors := Config.Parse(data)
+	if refreshMode {
+		for i, plain := range plains {
+			if hasOpenSpyOutput(plain) {
+				continue //already checked with the output handler's params
+			}
+			for _, paramError := range (OpenSpy.RedisParams{}).Check() {
+				validationErrors = append(validationErrors, Config.ValidationError{Pipeline: i, Path: fmt.Sprintf("$[%d]", i), Message: "refresh mode: " + paramError.Message})
+			}
+		}
+	}
+	if len(validationErrors) > 0 {
+		return nil, validationErrors
+	}
+	return plains, nil
+}
+
+func logConfigError(path string, err error) {
+	var validationErrors Config.ValidationErrors
+	if !errors.As(err, &validationErrors) {
+		slog.Error("Failed to read config", "path", path, "error", err)
+		return
+	}
+	for _, validationError := range validationErrors {
+		slog.Error("Invalid config", "path", path, "pipeline", validationError.Pipeline, "json_path", validationError.Path, "error", validationError.Message)
+	}
+}
+
+// The validate subcommand: checks a config without opening any sockets, exits non-zero if it has problems
+func runValidate(args []string) int {
+	var flags = flag.NewFlagSet("validate", flag.ExitOnError)
+	configPath := flags.String("config", "ms_config.json", "Path to config file")
+	refreshMode := flags.Bool("refresh-only", false, "Also check the Redis environment needed by --refresh-only")
+	flags.Parse(args)
+
+	return validateConfig(*configPath, *refreshMode)
+}
+
+func validateConfig(configPath string, refreshMode bool) int {
+	plains, err := loadConfig(configPath, refreshMode)
+	if err != nil {
+		var validationErrors Config.ValidationErrors
+		if errors.As(err, &validationErrors) {
+			for _, validationError := range validationErrors {
+				fmt.Println(validationError.Error())
+			}
+			fmt.Printf("%s: %d problem(s) found\n", configPath, len(validationErrors))
+		} else {
+			fmt.Println(err.Error())
+		}
+		return 1
+	}
+
+	fmt.Printf("%s: OK, %d pipeline(s)\n", configPath, len(plains))
+	return 0
+}